@@ -4,36 +4,62 @@ import (
 	"bufio"
 	"errors"
 	"github.com/fsnotify/fsnotify"
-	"log"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var interestingPorts = make(map[string]map[uint16]bool)
+// A file listing interesting ports ("proto:port" per line), reloaded when it changes
+type PortFile struct {
+	name             string // for log messages
+	fname            string
+	interestingPorts map[string]map[uint16]bool
+	stopWatching     chan bool // closed to stop the watcher of the previous file
+}
+
+// Destination ports (-ports)
+var DestPortFile = &PortFile{name: "Ports", interestingPorts: make(map[string]map[uint16]bool)}
+
+// Source ports (-src-port-file)
+var SourcePortFile = &PortFile{name: "Source ports", interestingPorts: make(map[string]map[uint16]bool)}
 
 func PortIsInteresting(proto string, port uint16) bool {
-	if len(interestingPorts) == 0 {
+	return DestPortFile.PortIsInteresting(proto, port)
+}
+
+func (pf *PortFile) PortIsInteresting(proto string, port uint16) bool {
+	if len(pf.interestingPorts) == 0 {
 		return true
 	}
-	portsForProto := interestingPorts[proto]
+	portsForProto := pf.interestingPorts[proto]
 	return portsForProto != nil && portsForProto[port]
 }
 
-var portfile string
-var reloadChannel chan bool = make(chan bool, 1)
+var reloadChannel chan *PortFile = make(chan *PortFile, 2)
 
-func checkReloads() {
+// (Re)start watching the file, after its name changed
+func (pf *PortFile) watch() {
+	if pf.stopWatching != nil {
+		close(pf.stopWatching)
+		pf.stopWatching = nil
+	}
+	if pf.fname != "" {
+		pf.stopWatching = make(chan bool)
+		go pf.checkReloads(pf.fname, pf.stopWatching)
+	}
+}
+
+func (pf *PortFile) checkReloads(fname string, stop chan bool) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal("fsnotify.NewWatcher:", err)
+		Fatal("ports", "fsnotify.NewWatcher failed", "err", err)
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(portfile)
+	err = watcher.Add(fname)
 	if err != nil {
-		log.Fatal("watcher.Add: ", err)
+		Fatal("ports", "watcher.Add failed", "file", fname, "err", err)
 	}
 
 	for {
@@ -46,26 +72,46 @@ func checkReloads() {
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				// log.Println("modified file:", event.Name)
 				time.Sleep(time.Duration(250000000)) // 250ms delay
-				reloadChannel <- true
+				reloadChannel <- pf
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
-				log.Println("fswatcher fatal error:", err)
+				Log("ports").Error("File watcher failed", "file", fname, "err", err)
 				return
 			}
-			log.Println("fswatcher error:", err)
+			Log("ports").Warn("File watcher error", "file", fname, "err", err)
+		case <-stop:
+			// file replaced by a configuration reload
+			return
 		}
 	}
 }
 
-func PortFileReloadChannel() chan bool {
+func PortFileReloadChannel() chan *PortFile {
 	return reloadChannel
 }
 
-func PortFileReload() error {
-	file, err := os.Open(portfile)
+func (pf *PortFile) Reload() error {
+	newInterestingPorts, numEntries, err := readPortFile(pf.fname)
+	if err == nil {
+		pf.interestingPorts = newInterestingPorts
+		Log("ports").Info("Reloaded port file", "ports", pf.name, "file", pf.fname, "entries", numEntries)
+	}
+	return err
+}
+
+func countPorts(ports map[string]map[uint16]bool) int {
+	numEntries := 0
+	for _, portsForProto := range ports {
+		numEntries += len(portsForProto)
+	}
+	return numEntries
+}
+
+func readPortFile(fname string) (map[string]map[uint16]bool, int, error) {
+	file, err := os.Open(fname)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer file.Close()
 
@@ -79,11 +125,11 @@ func PortFileReload() error {
 		}
 		protoport := strings.Split(line, ":")
 		if len(protoport) != 2 {
-			return errors.New("Invalid line (not format \"proto:port\"): " + line)
+			return nil, 0, errors.New("Invalid line (not format \"proto:port\"): " + line)
 		}
 		port, err := strconv.ParseUint(protoport[1], 10, 16)
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
 
 		if newInterestingPorts[protoport[0]] == nil {
@@ -92,19 +138,14 @@ func PortFileReload() error {
 		newInterestingPorts[protoport[0]][uint16(port)] = true
 		numEntries++
 	}
-	err = scanner.Err()
-	if err == nil {
-		interestingPorts = newInterestingPorts
-		log.Printf("[Ports] Reload portfile with %d entries\n", numEntries)
-	}
-	return err
+	return newInterestingPorts, numEntries, scanner.Err()
 }
 
-func PortFileInit(fname string) error {
-	portfile = fname
-	err := PortFileReload()
+func (pf *PortFile) Init(fname string) error {
+	pf.fname = fname
+	err := pf.Reload()
 	if err == nil {
-		go checkReloads()
+		pf.watch()
 	}
 	return err
 }
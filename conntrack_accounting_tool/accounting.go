@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/ti-mo/conntrack"
-	"log"
 	"net"
 	"net/netip"
 	"os"
@@ -18,37 +17,96 @@ type AccountingEntry struct {
 	connectionCount                int
 	connectionTime                 int64
 	openConnections                int
+	pseudoConnectionCount          int
+	pseudoConnectionTime           int64
+	tcpEstablished                 int
+	tcpOutcomes                    [4]int // indexed by TCPOutcome*
+	histograms                     *ConnectionHistograms
+	key                            FlowKey
+	estimate                       uint64 // traffic estimate for top-N selection (-max-keys)
+	heapIndex                      int
 }
 
-var AccountingTable = make(map[string]*AccountingEntry)
+// Add all counters of another entry
+func (e *AccountingEntry) Add(other *AccountingEntry) {
+	e.packetsSrcToDst += other.packetsSrcToDst
+	e.bytesSrcToDst += other.bytesSrcToDst
+	e.packetsDstToSrc += other.packetsDstToSrc
+	e.bytesDstToSrc += other.bytesDstToSrc
+	e.connectionCount += other.connectionCount
+	e.connectionTime += other.connectionTime
+	e.openConnections += other.openConnections
+	e.pseudoConnectionCount += other.pseudoConnectionCount
+	e.pseudoConnectionTime += other.pseudoConnectionTime
+	e.tcpEstablished += other.tcpEstablished
+	for i := range e.tcpOutcomes {
+		e.tcpOutcomes[i] += other.tcpOutcomes[i]
+	}
+	if other.histograms != nil {
+		if e.histograms == nil {
+			e.histograms = &ConnectionHistograms{}
+		}
+		e.histograms.duration.Add(&other.histograms.duration)
+		e.histograms.size.Add(&other.histograms.size)
+	}
+}
+
+// FlowKey identifies a row in the accounting table: the "proto,src,dst,port" columns
+// and the optional dimension columns, which are written after the counters.
+type FlowKey struct {
+	key        string
+	dimensions string
+}
+
+var AccountingTable = make(map[FlowKey]*AccountingEntry)
 
 func ConvertIp(ip netip.Addr) net.IP {
 	b := ip.As4()
 	return b[:]
 }
 
-func AccountingKey(flow *conntrack.Flow) string {
+func AccountingKey(ns int, flow *conntrack.Flow) FlowKey {
 	proto := ProtoLookup(flow.TupleOrig.Proto.Protocol)
 	s := proto + ","
-	s += ConvertIp(flow.TupleOrig.IP.SourceAddress).Mask(SourceGroupMask).String() + ","
-	s += ConvertIp(flow.TupleOrig.IP.DestinationAddress).Mask(DestGroupMask).String() + ","
-	if PortIsInteresting(proto, flow.TupleOrig.Proto.DestinationPort) {
-		s += strconv.FormatUint(uint64(flow.TupleOrig.Proto.DestinationPort), 10)
+	src, dst, port := SourceAddress(flow), DestAddress(flow), DestPort(flow)
+	if ServiceSideReversed(flow) {
+		src, dst, port = dst, src, SourcePort(flow)
+	}
+	s += GroupAddress(src, SourceGroupMask) + ","
+	s += GroupAddress(dst, DestGroupMask) + ","
+	if PortIsInteresting(proto, port) {
+		s += strconv.FormatUint(uint64(port), 10)
 	} else {
 		s += "-1"
 	}
-	return s
+	return FlowKey{s, AccountingDimensions(ns, flow)}
 }
 
-func getOrCreateAccountingTableEntry(key string) *AccountingEntry {
+func getOrCreateAccountingTableEntry(key FlowKey) *AccountingEntry {
 	entry := AccountingTable[key]
 	if entry == nil {
-		entry = &AccountingEntry{}
+		estimate := topNMakeRoom()
+		entry = &AccountingEntry{key: key, estimate: estimate}
 		AccountingTable[key] = entry
+		topNAdd(entry)
 	}
 	return entry
 }
 
+// Account the difference between current and accounted counter. If the current counter is lower,
+// the kernel counters have been reset (or zeroed) and everything we see is new traffic.
+// Returns true on a counter reset.
+func accountCounter(current uint64, accounted *uint64, total *uint64) bool {
+	reset := current < *accounted
+	if reset {
+		*total += current
+	} else {
+		*total += current - *accounted
+	}
+	*accounted = current
+	return reset
+}
+
 func AccountTraffic(info *ConnectionInfo) {
 	// Is there anything to account?
 	if info.packetsSrcToDst == info.packetsSrcToDstAccounted && info.bytesSrcToDst == info.bytesSrcToDstAccounted {
@@ -58,42 +116,76 @@ func AccountTraffic(info *ConnectionInfo) {
 	}
 	// Account data and reset connection
 	entry := getOrCreateAccountingTableEntry(info.key)
-	if info.packetsSrcToDst > info.packetsSrcToDstAccounted {
-		entry.packetsSrcToDst += info.packetsSrcToDst - info.packetsSrcToDstAccounted
-		info.packetsSrcToDstAccounted = info.packetsSrcToDst
+	bytesBefore := entry.bytesSrcToDst + entry.bytesDstToSrc
+	reset := false
+	if accountCounter(info.packetsSrcToDst, &info.packetsSrcToDstAccounted, &entry.packetsSrcToDst) {
+		reset = true
 	}
-	if info.packetsDstToSrc > info.packetsDstToSrcAccounted {
-		entry.packetsDstToSrc += info.packetsDstToSrc - info.packetsDstToSrcAccounted
-		info.packetsDstToSrcAccounted = info.packetsDstToSrc
+	if accountCounter(info.packetsDstToSrc, &info.packetsDstToSrcAccounted, &entry.packetsDstToSrc) {
+		reset = true
 	}
-	if info.bytesSrcToDst > info.bytesSrcToDstAccounted {
-		entry.bytesSrcToDst += info.bytesSrcToDst - info.bytesSrcToDstAccounted
-		info.bytesSrcToDstAccounted = info.bytesSrcToDst
+	if accountCounter(info.bytesSrcToDst, &info.bytesSrcToDstAccounted, &entry.bytesSrcToDst) {
+		reset = true
 	}
-	if info.bytesDstToSrc > info.bytesDstToSrcAccounted {
-		entry.bytesDstToSrc += info.bytesDstToSrc - info.bytesDstToSrcAccounted
-		info.bytesDstToSrcAccounted = info.bytesDstToSrc
+	if accountCounter(info.bytesDstToSrc, &info.bytesDstToSrcAccounted, &entry.bytesDstToSrc) {
+		reset = true
 	}
+	if reset {
+		CounterResetCounter++
+	}
+	topNUpdate(entry, entry.bytesSrcToDst+entry.bytesDstToSrc-bytesBefore)
 }
 
-func AccountConnectionClose(info *ConnectionInfo) {
+func AccountConnectionClose(info *ConnectionInfo, end time.Time) {
 	if !info.connectionTrackingDisabled {
 		info.connectionTrackingDisabled = true
-		duration := time.Now().Sub(info.start).Milliseconds()
+		duration := end.Sub(info.start).Milliseconds()
 		entry := getOrCreateAccountingTableEntry(info.key)
+		if info.pseudoConnection {
+			// no histograms, the duration includes the conntrack timeout
+			entry.pseudoConnectionCount += 1
+			entry.pseudoConnectionTime += duration
+			return
+		}
 		entry.connectionCount += 1
 		entry.connectionTime += duration
+		if info.sizePending {
+			info.closedDuration = duration
+		} else if TrackHistograms {
+			ObserveConnection(entry, duration, info.bytesSrcToDst+info.bytesDstToSrc)
+		}
 	}
 }
 
+// Called with the final counters of a connection (DESTROY, reaped), records the histogram sample
+// of a TCP connection that has been counted at its close
+func AccountFinalCounters(info *ConnectionInfo) {
+	if info.sizePending {
+		info.sizePending = false
+		ObserveConnection(getOrCreateAccountingTableEntry(info.key), info.closedDuration, info.bytesSrcToDst+info.bytesDstToSrc)
+	}
+}
+
+func AccountTCPEstablished(info *ConnectionInfo) {
+	entry := getOrCreateAccountingTableEntry(info.key)
+	entry.tcpEstablished += 1
+}
+
+func AccountTCPOutcome(info *ConnectionInfo, outcome int) {
+	entry := getOrCreateAccountingTableEntry(info.key)
+	entry.tcpOutcomes[outcome] += 1
+}
+
 func AccountOpenConnection(info *ConnectionInfo) {
 	entry := getOrCreateAccountingTableEntry(info.key)
 	entry.openConnections += 1
 }
 
 func FlushAccountingTableToOutput(timestamp time.Time) {
+	topNFinish()
 	start := time.Now()
 	size := len(AccountingTable)
+	sinkErrors := sinkErrorCount()
 
 	var f *os.File
 	var err error
@@ -101,48 +193,147 @@ func FlushAccountingTableToOutput(timestamp time.Time) {
 		fname := filepath.Join(OutputFolder, "traffic_"+timestamp.Format("2006-01-02T15_04_05")+".csv")
 		f, err = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			log.Fatal("Open csv file", err)
+			Log("output").Error("Could not open csv file", "err", err)
+			recordSinkError()
+			f = nil
+		} else {
+			defer f.Close()
+			if CSVHeader {
+				_, err = f.WriteString(CSVSchemaHeader())
+				if err != nil {
+					Log("output").Error("Write error (file)", "err", err)
+					recordSinkError()
+					f = nil
+				}
+			}
 		}
-		defer f.Close()
 	}
 
+	// After a write error, the rest of this interval is skipped for that sink
+	outputFailed := false
+	var archiveData, jsonData strings.Builder
+	round := RoundNumber(timestamp)
 	for key, entry := range AccountingTable {
-		// format:
-		// time,proto,src,dst,port,packets_src,packets_dst,bytes_src,bytes_dst,connection_count,connection_time,open_connections
-		var line strings.Builder
-		line.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
-		line.WriteString(",")
-		line.WriteString(key)
-		line.WriteString(",")
-		line.WriteString(strconv.FormatUint(entry.packetsSrcToDst, 10))
-		line.WriteString(",")
-		line.WriteString(strconv.FormatUint(entry.packetsDstToSrc, 10))
-		line.WriteString(",")
-		line.WriteString(strconv.FormatUint(entry.bytesSrcToDst, 10))
-		line.WriteString(",")
-		line.WriteString(strconv.FormatUint(entry.bytesDstToSrc, 10))
-		line.WriteString(",")
-		line.WriteString(strconv.Itoa(entry.connectionCount))
-		line.WriteString(",")
-		line.WriteString(strconv.FormatInt(entry.connectionTime, 10))
-		if TrackOpenConnections {
-			line.WriteString(",")
-			line.WriteString(strconv.Itoa(entry.openConnections))
+		line := formatCSVLine(timestamp, key, entry, round)
+		if ArchiveFolder != "" {
+			archiveData.WriteString(line)
 		}
-		line.WriteString("\n")
-		_, err := Output.WriteString(line.String())
-		if err != nil {
-			log.Fatal("Output write error: ", err)
+		if JSONOutput != "" {
+			jsonData.WriteString(formatJSONLine(timestamp, key, entry, round))
+		}
+		if !outputFailed {
+			outputFailed = !writeOutput(line)
 		}
 		if f != nil {
-			_, err := f.WriteString(line.String())
+			_, err := f.WriteString(line)
 			if err != nil {
-				log.Fatal("Output write error (file): ", err)
+				Log("output").Error("Write error (file)", "err", err)
+				recordSinkError()
+				f = nil
 			}
 		}
 	}
+	if ArchiveFolder != "" {
+		WriteArchive(timestamp, archiveData.String())
+	}
+	if JSONOutput != "" && jsonData.Len() > 0 {
+		WriteJSONOutput(jsonData.String())
+	}
+	if TrackHistograms {
+		FlushHistograms(timestamp, AccountingTable)
+	}
+	if TrafficMatrix {
+		FlushTrafficMatrix(timestamp, AccountingTable)
+	}
 	// Clear accounting table
-	AccountingTable = make(map[string]*AccountingEntry)
+	AccountingTable = make(map[FlowKey]*AccountingEntry)
+
+	recordFlush(size, time.Now().Sub(start), sinkErrorCount() != sinkErrors)
+	Log("output").Info("Wrote accounting table", "entries", size, "duration_ms", time.Now().Sub(start).Milliseconds())
+}
+
+// Write to the output (pipe / stdout), returns false on errors
+func writeOutput(s string) bool {
+	_, err := Output.WriteString(s)
+	if err != nil {
+		Log("output").Error("Write error", "err", err)
+		recordSinkError()
+		return false
+	}
+	return true
+}
+
+// Are there columns after open_connections (besides dimensions)?
+func extendedColumns() bool {
+	return TrackTCPOutcomes || TrackPseudoConnections || RoundsEnabled()
+}
+
+// CSVColumns returns the column names of the output for the current configuration
+func CSVColumns() []string {
+	columns := []string{"time", "proto", "src", "dst", "port", "packets_src", "packets_dst", "bytes_src", "bytes_dst", "connection_count", "connection_time"}
+	dimensions := DimensionNames()
+	if TrackOpenConnections || extendedColumns() || len(dimensions) > 0 {
+		columns = append(columns, "open_connections")
+	}
+	if TrackTCPOutcomes {
+		columns = append(columns, "tcp_established", "tcp_refused", "tcp_handshake_failed", "tcp_reset", "tcp_timeout")
+	}
+	if TrackPseudoConnections {
+		columns = append(columns, "pseudo_connection_count", "pseudo_connection_time")
+	}
+	columns = append(columns, dimensions...)
+	if RoundsEnabled() {
+		columns = append(columns, "round")
+	}
+	return columns
+}
 
-	log.Println("[Output] wrote", size, "entries in", time.Now().Sub(start).Milliseconds(), "ms")
+func formatCSVLine(timestamp time.Time, key FlowKey, entry *AccountingEntry, round int) string {
+	// format:
+	// time,proto,src,dst,port,packets_src,packets_dst,bytes_src,bytes_dst,connection_count,connection_time,open_connections
+	//     [,tcp_established,tcp_refused,tcp_handshake_failed,tcp_reset,tcp_timeout]
+	//     [,pseudo_connection_count,pseudo_connection_time]
+	//     [,namespace][,zone][,mark][,labels][,src_port][,src_reply][,dst_reply][,direction][,round]
+	var line strings.Builder
+	line.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	line.WriteString(",")
+	line.WriteString(key.key)
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(entry.packetsSrcToDst, 10))
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(entry.packetsDstToSrc, 10))
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(entry.bytesSrcToDst, 10))
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(entry.bytesDstToSrc, 10))
+	line.WriteString(",")
+	line.WriteString(strconv.Itoa(entry.connectionCount))
+	line.WriteString(",")
+	line.WriteString(strconv.FormatInt(entry.connectionTime, 10))
+	// with additional columns, open_connections is always present to keep the column order fixed
+	if TrackOpenConnections || extendedColumns() || key.dimensions != "" {
+		line.WriteString(",")
+		line.WriteString(strconv.Itoa(entry.openConnections))
+	}
+	if TrackTCPOutcomes {
+		line.WriteString(",")
+		line.WriteString(strconv.Itoa(entry.tcpEstablished))
+		for _, count := range entry.tcpOutcomes {
+			line.WriteString(",")
+			line.WriteString(strconv.Itoa(count))
+		}
+	}
+	if TrackPseudoConnections {
+		line.WriteString(",")
+		line.WriteString(strconv.Itoa(entry.pseudoConnectionCount))
+		line.WriteString(",")
+		line.WriteString(strconv.FormatInt(entry.pseudoConnectionTime, 10))
+	}
+	line.WriteString(key.dimensions)
+	if RoundsEnabled() {
+		line.WriteString(",")
+		line.WriteString(strconv.Itoa(round))
+	}
+	line.WriteString("\n")
+	return line.String()
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Archive of the traffic output (from command line): one (compressed) csv file per period, with retention.
+// Files are written as "traffic_<period start>.csv[.gz|.zst].part" and renamed when the period is over
+// (or on shutdown / at the next start after a crash, the period continues with "traffic_<period start>_<n>.csv[.gz|.zst]").
+var ArchiveFolder string
+var ArchivePeriod = time.Hour
+var ArchiveCompression = "gzip"
+
+// Retention, 0 = unlimited. Oldest files are deleted first.
+var ArchiveMaxAge time.Duration
+var ArchiveMaxSize int64
+
+// Compressing writer (gzip or zstd)
+type archiveCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Currently open archive file
+var archive struct {
+	periodStart time.Time
+	fname       string
+	file        *os.File
+	writer      io.Writer
+	compressor  archiveCompressor
+}
+
+func ParseArchiveCompression(s string) (string, error) {
+	switch s {
+	case "gzip", "zstd", "none":
+		return s, nil
+	}
+	return s, errors.New("Invalid archive compression (gzip, zstd or none): " + s)
+}
+
+// Parse a size like "500M" or "10G" (bytes, with optional K / M / G / T suffix)
+func ParseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("Invalid size: " + s)
+	}
+	return size * multiplier, nil
+}
+
+// Name of the archive file of a period. Finished files are never overwritten: if the file of the period
+// already exists (finished on shutdown or after a crash), a numbered file is used.
+func archiveFileName(periodStart time.Time) string {
+	base := filepath.Join(ArchiveFolder, "traffic_"+periodStart.Format("2006-01-02T15_04_05"))
+	extension := ".csv"
+	switch ArchiveCompression {
+	case "gzip":
+		extension += ".gz"
+	case "zstd":
+		extension += ".zst"
+	}
+	fname := base + extension
+	for n := 1; ; n++ {
+		if _, err := os.Stat(fname); err != nil {
+			return fname
+		}
+		fname = base + "_" + strconv.Itoa(n) + extension
+	}
+}
+
+func openArchive(periodStart time.Time) error {
+	fname := archiveFileName(periodStart)
+	file, err := os.OpenFile(fname+".part", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var compressor archiveCompressor
+	switch ArchiveCompression {
+	case "gzip":
+		compressor = gzip.NewWriter(file)
+	case "zstd":
+		compressor, err = zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	archive.periodStart = periodStart
+	archive.fname = fname
+	archive.file = file
+	archive.writer = file
+	archive.compressor = compressor
+	if compressor != nil {
+		archive.writer = compressor
+	}
+	if CSVHeader {
+		_, err = io.WriteString(archive.writer, CSVSchemaHeader())
+		if err != nil {
+			return err
+		}
+	}
+	Log("archive").Info("Opened archive file", "file", fname+".part")
+	return nil
+}
+
+// Close the current archive file and make it visible under its final name
+func CloseArchive() {
+	if archive.file == nil {
+		return
+	}
+	var err error
+	if archive.compressor != nil {
+		err = archive.compressor.Close()
+	}
+	if closeErr := archive.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(archive.fname+".part", archive.fname)
+	}
+	if err != nil {
+		Log("archive").Error("Could not close archive file", "file", archive.fname, "err", err)
+		recordSinkError()
+	}
+	archive.file = nil
+}
+
+// Write the output of one interval to the archive, rotating files at period boundaries
+func WriteArchive(timestamp time.Time, data string) {
+	periodStart := timestamp.Add(-time.Nanosecond).Truncate(ArchivePeriod)
+	if archive.file != nil && !archive.periodStart.Equal(periodStart) {
+		CloseArchive()
+		applyArchiveRetention()
+	}
+	if archive.file == nil {
+		if err := openArchive(periodStart); err != nil {
+			Log("archive").Error("Could not open archive file", "err", err)
+			recordSinkError()
+			return
+		}
+	}
+	_, err := io.WriteString(archive.writer, data)
+	if err == nil && archive.compressor != nil {
+		// complete compressed blocks, so a crash loses at most the current interval
+		err = archive.compressor.Flush()
+	}
+	if err != nil {
+		Log("archive").Error("Write error", "file", archive.fname, "err", err)
+		recordSinkError()
+	}
+}
+
+// Delete archive files that are too old, then the oldest files until the archive is small enough
+func applyArchiveRetention() {
+	if ArchiveMaxAge <= 0 && ArchiveMaxSize <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(ArchiveFolder)
+	if err != nil {
+		Log("archive").Error("Could not list archive folder", "err", err)
+		return
+	}
+	type archiveFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []archiveFile
+	var totalSize int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "traffic_") || !(strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".csv.gz") || strings.HasSuffix(name, ".csv.zst")) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, archiveFile{name, info.Size(), info.ModTime()})
+		totalSize += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	deleted := 0
+	for _, file := range files {
+		tooOld := ArchiveMaxAge > 0 && time.Now().Sub(file.modTime) > ArchiveMaxAge
+		tooLarge := ArchiveMaxSize > 0 && totalSize > ArchiveMaxSize
+		if !tooOld && !tooLarge {
+			break
+		}
+		err := os.Remove(filepath.Join(ArchiveFolder, file.name))
+		if err != nil {
+			Log("archive").Error("Could not delete archive file", "file", file.name, "err", err)
+			continue
+		}
+		totalSize -= file.size
+		deleted++
+	}
+	if deleted > 0 {
+		Log("archive").Info("Deleted old archive files", "files", deleted, "archive_bytes", totalSize)
+	}
+}
+
+// Create the archive folder and finish ".part" files left over from a crash. They are not continued:
+// the last compressed block is incomplete, anything appended would be unreadable.
+func ArchiveInit() error {
+	err := os.MkdirAll(ArchiveFolder, 0o755)
+	if err != nil {
+		return err
+	}
+	parts, err := filepath.Glob(filepath.Join(ArchiveFolder, "traffic_*.part"))
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := os.Rename(part, strings.TrimSuffix(part, ".part")); err != nil {
+			return err
+		}
+		Log("archive").Info("Finished archive file from previous run", "file", strings.TrimSuffix(part, ".part"))
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Configuration file (from command line), options in the format "name = value" with the names of the command line flags
+// (a subset of TOML: strings may be quoted, no tables). Options given on the command line take precedence.
+var ConfigFile string
+
+// Only validate the configuration and print it (from command line)
+var CheckConfig bool
+
+// Options that can be changed at runtime (SIGHUP)
+type ReloadableConfig struct {
+	SourceFilter    string
+	SourceGroupMask string
+	DestFilter      string
+	DestGroupMask   string
+	GroupRules      string
+	ExcludeIP       string
+	IncludeICMP     bool
+	PortFile        string
+	OutputFolder    string
+	Interval        int64
+}
+
+var Config = ReloadableConfig{SourceGroupMask: "255.255.255.255", DestGroupMask: "255.255.255.255", Interval: 15}
+
+// Config after parsing the command line (without config file)
+var commandLineConfig ReloadableConfig
+
+// Flags given on the command line
+var commandLineFlags = make(map[string]bool)
+
+// Options from the config file at startup, to detect changes that require a restart
+var startupFileValues = make(map[string]string)
+
+// Validated config, applied after the next flush
+var pendingConfig *parsedConfig
+
+func (c *ReloadableConfig) registerFlags(flags *flag.FlagSet) {
+	//IPv4 only for now
+	flags.StringVar(&c.SourceFilter, "src", c.SourceFilter, "Source network filter (CIDR notation)")
+	flags.StringVar(&c.SourceGroupMask, "src-group-mask", c.SourceGroupMask, "Source filter mask")
+	flags.StringVar(&c.DestFilter, "dst", c.DestFilter, "Destination network filter (CIDR notation)")
+	flags.StringVar(&c.DestGroupMask, "dst-group-mask", c.DestGroupMask, "Destination filter mask")
+	flags.StringVar(&c.GroupRules, "group-rules", c.GroupRules, "File with grouping rules (\"<cidr> mask|prefix|team|label <argument>\"), applied before the group masks")
+	flags.StringVar(&c.ExcludeIP, "exclude-ip", c.ExcludeIP, "Exclude connections from or to a single IP")
+	flags.BoolVar(&c.IncludeICMP, "include-icmp", c.IncludeICMP, "Include ICMP sessions")
+	flags.StringVar(&c.PortFile, "ports", c.PortFile, "File listing ports to track")
+	flags.StringVar(&c.OutputFolder, "output", c.OutputFolder, "Output folder to store csv data")
+	flags.Int64Var(&c.Interval, "interval", c.Interval, "Output interval")
+}
+
+// All options of a config as strings, by flag name
+func (c ReloadableConfig) values() map[string]string {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.registerFlags(flags)
+	values := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+type configChange struct {
+	name, old, new string
+}
+
+// Differences between two configs
+func (c ReloadableConfig) diff(other ReloadableConfig) []configChange {
+	var changes []configChange
+	newValues := other.values()
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.registerFlags(flags)
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != newValues[f.Name] {
+			changes = append(changes, configChange{f.Name, f.Value.String(), newValues[f.Name]})
+		}
+	})
+	return changes
+}
+
+// Read a config file and pass all options to set
+func ReadConfigFile(fname string, set func(name, value string) error) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid line (not format \"name = value\"): " + line)
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "-")
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return errors.New("Invalid string in line: " + line)
+			}
+		}
+		err = set(name, value)
+		if err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// Apply the config file to the command line flags (called after flag.Parse)
+func ConfigFileInit() error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	commandLineConfig = Config
+	if ConfigFile == "" {
+		return nil
+	}
+	return ReadConfigFile(ConfigFile, func(name, value string) error {
+		if commandLineFlags[name] {
+			return nil
+		}
+		startupFileValues[name] = value
+		return flag.Set(name, value)
+	})
+}
+
+// Parsed and validated ReloadableConfig
+type parsedConfig struct {
+	config              ReloadableConfig
+	sourceFilterPresent bool
+	sourceFilterNet     net.IPNet
+	sourceGroupMask     net.IPMask
+	destFilterPresent   bool
+	destFilterNet       net.IPNet
+	destGroupMask       net.IPMask
+	groupRules          []*GroupRule
+	ipExcludePresent    bool
+	ipExclude           netip.Addr
+	interestingPorts    map[string]map[uint16]bool
+}
+
+func (c ReloadableConfig) parse() (*parsedConfig, error) {
+	parsed := &parsedConfig{config: c}
+	if c.SourceFilter != "" {
+		_, netrange, err := net.ParseCIDR(c.SourceFilter)
+		if err != nil {
+			return nil, errors.New("Invalid src filter: " + err.Error())
+		}
+		parsed.sourceFilterNet = *netrange
+		parsed.sourceFilterPresent = true
+	}
+	if c.DestFilter != "" {
+		_, netrange, err := net.ParseCIDR(c.DestFilter)
+		if err != nil {
+			return nil, errors.New("Invalid dst filter: " + err.Error())
+		}
+		parsed.destFilterNet = *netrange
+		parsed.destFilterPresent = true
+	}
+	var err error
+	parsed.sourceGroupMask, err = parseGroupMask(c.SourceGroupMask)
+	if err != nil {
+		return nil, errors.New("Invalid src group mask: " + err.Error())
+	}
+	parsed.destGroupMask, err = parseGroupMask(c.DestGroupMask)
+	if err != nil {
+		return nil, errors.New("Invalid dst group mask: " + err.Error())
+	}
+	if c.GroupRules != "" {
+		parsed.groupRules, err = LoadGroupRules(c.GroupRules)
+		if err != nil {
+			return nil, errors.New("Group rules: " + err.Error())
+		}
+	}
+	if c.ExcludeIP != "" {
+		ip, err := netip.ParseAddr(c.ExcludeIP)
+		if err != nil {
+			return nil, errors.New("Cannot parse exclude ip: " + err.Error())
+		}
+		parsed.ipExclude = ip
+		parsed.ipExcludePresent = true
+	}
+	if c.PortFile != "" {
+		ports, _, err := readPortFile(c.PortFile)
+		if err != nil {
+			return nil, errors.New("Port file: " + err.Error())
+		}
+		parsed.interestingPorts = ports
+	}
+	if ServiceSideAttribution && len(parsed.interestingPorts) == 0 {
+		return nil, errors.New("Service side attribution requires a port file (-ports)")
+	}
+	if TrafficMatrix && c.OutputFolder == "" {
+		return nil, errors.New("Traffic matrix requires an output folder (-output)")
+	}
+	if c.OutputFolder != "" {
+		// the output folder is created if missing
+		if err := checkDirectory(filepath.Dir(filepath.Clean(c.OutputFolder))); err != nil {
+			return nil, errors.New("Output folder: " + err.Error())
+		}
+	}
+	if c.Interval <= 1 {
+		parsed.config.Interval = Interval
+	}
+	return parsed, nil
+}
+
+// Parse an IPv4 group mask like "255.239.255.0" (non-contiguous masks are allowed)
+func parseGroupMask(s string) (net.IPMask, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return nil, errors.New("not an IPv4 mask: \"" + s + "\"")
+	}
+	return net.IPMask(ip.To4()), nil
+}
+
+func checkDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(path + " is not a directory")
+	}
+	return nil
+}
+
+// Make a parsed config the active one
+func (parsed *parsedConfig) apply() {
+	c := parsed.config
+	SourceFilterPresent = parsed.sourceFilterPresent
+	SourceFilterNet = parsed.sourceFilterNet
+	SourceGroupMask = parsed.sourceGroupMask
+	DestFilterPresent = parsed.destFilterPresent
+	DestFilterNet = parsed.destFilterNet
+	DestGroupMask = parsed.destGroupMask
+	GroupRules = parsed.groupRules
+	IpExcludePresent = parsed.ipExcludePresent
+	IpExclude = parsed.ipExclude
+	ICMPInclude = c.IncludeICMP
+	if c.PortFile != DestPortFile.fname {
+		DestPortFile.fname = c.PortFile
+		DestPortFile.watch()
+	}
+	DestPortFile.interestingPorts = parsed.interestingPorts
+	if DestPortFile.interestingPorts == nil {
+		DestPortFile.interestingPorts = make(map[string]map[uint16]bool)
+	}
+	if OutputFolder != c.OutputFolder && c.OutputFolder != "" {
+		_ = os.Mkdir(c.OutputFolder, 0o755)
+	}
+	OutputFolder = c.OutputFolder
+	Interval = c.Interval
+	Config = c
+}
+
+// Parse and apply the config at startup
+func ApplyConfig() error {
+	parsed, err := Config.parse()
+	if err != nil {
+		return err
+	}
+	parsed.apply()
+	if SourceFilterPresent {
+		Log("config").Info("Source filter", "network", SourceFilterNet.String())
+	}
+	if DestFilterPresent {
+		Log("config").Info("Destination filter", "network", DestFilterNet.String())
+	}
+	if description := describeMask(SourceGroupMask); description != "" {
+		Log("config").Info("Non-contiguous source group mask", "mask", Config.SourceGroupMask, "description", strings.Trim(description, " ()"))
+	}
+	if description := describeMask(DestGroupMask); description != "" {
+		Log("config").Info("Non-contiguous destination group mask", "mask", Config.DestGroupMask, "description", strings.Trim(description, " ()"))
+	}
+	if len(GroupRules) > 0 {
+		Log("config").Info("Loaded grouping rules", "file", Config.GroupRules, "rules", len(GroupRules))
+	}
+	if IpExcludePresent {
+		Log("config").Info("Exclude IP", "ip", IpExclude.String())
+	}
+	if Config.PortFile != "" {
+		Log("ports").Info("Loaded port file", "ports", DestPortFile.name, "file", DestPortFile.fname, "entries", countPorts(DestPortFile.interestingPorts))
+	}
+	return nil
+}
+
+// Re-read the configuration (SIGHUP). The new config is validated now, and applied after the next flush.
+func ReloadConfiguration() error {
+	newConfig := commandLineConfig
+	if ConfigFile != "" {
+		flags := flag.NewFlagSet("config", flag.ContinueOnError)
+		newConfig.registerFlags(flags)
+		err := ReadConfigFile(ConfigFile, func(name, value string) error {
+			if commandLineFlags[name] {
+				return nil
+			}
+			if flags.Lookup(name) == nil {
+				// not reloadable (e.g. the -mark / -zone dump filters), the running value is kept
+				if value != startupFileValues[name] {
+					Log("config").Warn("Option can not be reloaded, the change requires a restart", "option", name, "value", value)
+				}
+				return nil
+			}
+			return flags.Set(name, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	parsed, err := newConfig.parse()
+	if err != nil {
+		return err
+	}
+	pendingConfig = parsed
+	Log("config").Info("Reloaded configuration, applied after the next flush")
+	return nil
+}
+
+// Apply a reloaded config (at an interval boundary, after the flush)
+func applyPendingConfig() {
+	if pendingConfig == nil {
+		return
+	}
+	changes := Config.diff(pendingConfig.config)
+	pendingConfig.apply()
+	pendingConfig = nil
+	if SourcePortFile != DestPortFile && SourcePortFile.fname != "" {
+		err := SourcePortFile.Reload()
+		if err != nil {
+			Log("ports").Error("Could not load port file", "ports", SourcePortFile.name, "file", SourcePortFile.fname, "err", err)
+		}
+	}
+	if len(changes) == 0 {
+		Log("config").Info("Applied configuration, no options changed")
+	}
+	for _, change := range changes {
+		Log("config").Info("Changed option", "option", change.name, "old", change.old, "new", change.new)
+	}
+}
+
+// Create a channel that delivers reload signals
+func ReloadSignalChannel() chan os.Signal {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	return signalChannel
+}
+
+// Validate the options that are not checked while parsing (-check-config)
+func CheckConfiguration(pipeFile string) error {
+	_, err := Config.parse()
+	if err != nil {
+		return err
+	}
+	if pipeFile != "" {
+		if err := checkDirectory(filepath.Dir(pipeFile)); err != nil {
+			return errors.New("Pipe: " + err.Error())
+		}
+		if info, err := os.Stat(pipeFile); err == nil && info.Mode()&os.ModeNamedPipe == 0 {
+			return errors.New("Pipe: " + pipeFile + " exists and is not a named pipe")
+		}
+	}
+	if SchemaFile != "" {
+		if err := checkDirectory(filepath.Dir(SchemaFile)); err != nil {
+			return errors.New("Schema file: " + err.Error())
+		}
+	}
+	if JSONOutput != "" {
+		if err := checkDirectory(filepath.Dir(JSONOutput)); err != nil {
+			return errors.New("JSON output: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Print the effective configuration in config file format
+func PrintConfig() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "check-config" {
+			return
+		}
+		if value, ok := f.Value.(flag.Getter).Get().(string); ok {
+			fmt.Printf("%s = %s\n", f.Name, strconv.Quote(value))
+		} else {
+			fmt.Printf("%s = %s\n", f.Name, f.Value.String())
+		}
+	})
+}
@@ -4,124 +4,307 @@ import (
 	"github.com/mdlayher/netlink"
 	"github.com/ti-mo/conntrack"
 	"github.com/ti-mo/netfilter"
-	"log"
+	"sync"
 	"time"
 )
 
 type ConnectionInfo struct {
-	key                                              string
+	key                                              FlowKey
+	reversed                                         bool // accounted to the service side, counters are swapped
 	packetsSrcToDst, bytesSrcToDst                   uint64
 	packetsDstToSrc, bytesDstToSrc                   uint64
 	packetsSrcToDstAccounted, bytesSrcToDstAccounted uint64
 	packetsDstToSrcAccounted, bytesDstToSrcAccounted uint64
-	connectionTrackingDisabled                       bool // connection is untrackable or closed
-	start                                            time.Time
+	connectionTrackingDisabled                       bool            // connection is untrackable or closed
+	start                                            time.Time       // kernel timestamp once known (dump, DESTROY), otherwise time of the NEW event
+	tuple                                            conntrack.Tuple // original tuple, to detect flow ID reuse
+	kernelStart                                      time.Time       // kernel timestamp (if nf_conntrack_timestamp is enabled)
+	created                                          time.Time       // when we added this entry
+	lastDump                                         uint64          // generation of the last dump containing this flow
+	missedDumps                                      int             // consecutive dumps this flow was missing from
+	tcpTracked, tcpEstablished, tcpClosing           bool            // TCP state (if -tcp-outcomes is set)
+	tcpOutcomeDone                                   bool
+	sizePending                                      bool  // closed (TCP FIN), the histogram sample waits for the final counters
+	closedDuration                                   int64 // duration of the closed connection (ms), for the pending histogram sample
+	pseudoConnection                                 bool  // UDP / ICMP flow, counted separately (if -pseudo-connections is set)
 }
 
-var connections = make(map[uint32]*ConnectionInfo)
+// Flow IDs are only unique within a network namespace
+type ConnectionID struct {
+	ns int
+	id uint32
+}
+
+var connections = make(map[ConnectionID]*ConnectionInfo)
+
+// Anomaly counters (since start)
+var FlowIDReuseCounter int       // flow IDs that were reused by the kernel for another connection (DESTROY event lost)
+var CounterResetCounter int      // connections whose traffic counters decreased
+var ReapedConnectionCounter int  // connections that disappeared from conntrack without DESTROY event
+var DroppedConnectionCounter int // connections not tracked because the connection table was full
+
+// Count connectionless flows (UDP, ICMP, UDPLite) as pseudo-connections (from command line)
+var TrackPseudoConnections bool
+
+func isConnectionOriented(proto uint8) bool {
+	return proto == PROTO_TCP || proto == PROTO_DCCP || proto == PROTO_SCTP
+}
+
+func isPseudoConnection(proto uint8) bool {
+	return TrackPseudoConnections && (proto == PROTO_UDP || proto == PROTO_ICMP || proto == PROTO_UDPLITE)
+}
+
+// Upper bound for the size of the connection table (from command line)
+var MaxConnections = 1048576
+
+// Incremented with every dump we handle
+var dumpGeneration uint64
+
+// Without -netns, we receive the events of all namespaces (ListenAllNSID), but only dump our own.
+// Flows of other namespaces never show up in our dumps, their DESTROY event carries all their traffic,
+// so connections only seen in events are reaped after this age instead (the kernel's default timeout
+// of established TCP connections), which still bounds the table if their DESTROY events are lost.
+const EventOnlyConnectionMaxAge = 5 * 24 * time.Hour
+
+// Add a connection to the table, unless the table is full
+func addConnection(id ConnectionID, info *ConnectionInfo) {
+	if MaxConnections > 0 && len(connections) >= MaxConnections {
+		DroppedConnectionCounter++
+		return
+	}
+	info.created = time.Now()
+	connections[id] = info
+}
+
+// Close out all connections that are missing in two consecutive dumps - we lost their DESTROY event.
+// Their traffic has already been accounted up to the last dump containing them.
+// A connection missing in only one dump might have been closed after the previous dump, with its
+// DESTROY event still queued, which is handled before the next dump.
+// Connections created after the dump started are still missing in it and are kept.
+func reapMissingConnections(dumpStarted time.Time) {
+	for id, info := range connections {
+		if info.lastDump == dumpGeneration {
+			info.missedDumps = 0
+			continue
+		}
+		if !info.created.Before(dumpStarted) {
+			continue
+		}
+		if info.lastDump == 0 && !DimensionNamespace && dumpStarted.Sub(info.created) < EventOnlyConnectionMaxAge {
+			// might belong to another namespace, see EventOnlyConnectionMaxAge
+			continue
+		}
+		info.missedDumps++
+		if info.missedDumps < 2 {
+			continue
+		}
+		delete(connections, id)
+		ReapedConnectionCounter++
+		if !info.connectionTrackingDisabled {
+			AccountConnectionClose(info, time.Now())
+		}
+		AccountFinalCounters(info)
+	}
+}
+
+// A conntrack event, tagged with the index of the namespace it originates from
+type NamespacedEvent struct {
+	ns    int
+	event conntrack.Event
+}
 
 func accountOpenConnections() {
 	for _, info := range connections {
-		if !info.connectionTrackingDisabled {
+		if !info.connectionTrackingDisabled && !info.pseudoConnection {
 			AccountOpenConnection(info)
 		}
 	}
 }
 
+// Find the connection belonging to a flow. If the ID belongs to another connection, the kernel has
+// reused the ID and we missed the DESTROY event - the old connection is closed and forgotten.
+func lookupConnection(ns int, flow *conntrack.Flow) (*ConnectionInfo, bool) {
+	id := ConnectionID{ns, flow.ID}
+	info, ok := connections[id]
+	if !ok {
+		return nil, false
+	}
+	sameStart := info.kernelStart.IsZero() || flow.Timestamp.Start.IsZero() || info.kernelStart.Equal(flow.Timestamp.Start)
+	if info.tuple == flow.TupleOrig && sameStart {
+		return info, true
+	}
+	FlowIDReuseCounter++
+	delete(connections, id)
+	if !info.connectionTrackingDisabled {
+		AccountConnectionClose(info, time.Now())
+	}
+	AccountFinalCounters(info)
+	return nil, false
+}
+
 func handleDump(dump DumpResult) {
 	if len(dump.flows) == 0 {
 		return
 	}
 	start := time.Now()
-	var interestingFlowCounter int
-	for _, flow := range dump.flows {
-		if FlowIsInteresting(&flow) {
-			interestingFlowCounter++
-			if info, ok := connections[flow.ID]; ok {
-				// We know this flow, update its stats
-				if flow.CountersOrig.Packets != 0 && flow.CountersOrig.Bytes != 0 {
-					info.packetsSrcToDst = flow.CountersOrig.Packets
-					info.bytesSrcToDst = flow.CountersOrig.Bytes
-				}
-				if flow.CountersReply.Packets != 0 && flow.CountersReply.Bytes != 0 {
-					info.packetsDstToSrc = flow.CountersReply.Packets
-					info.bytesDstToSrc = flow.CountersReply.Bytes
-				}
-				AccountTraffic(info)
-			} else {
-				// We don't know this flow, so we can't do connection tracking.
-				// But we can count future traffic if accounting is enabled.
-				if flow.CountersOrig.Packets != 0 || flow.CountersReply.Packets != 0 {
-					connections[flow.ID] = &ConnectionInfo{
-						key:                        AccountingKey(&flow),
-						packetsSrcToDstAccounted:   flow.CountersOrig.Packets,
-						bytesSrcToDstAccounted:     flow.CountersOrig.Bytes,
-						packetsDstToSrcAccounted:   flow.CountersReply.Packets,
-						bytesDstToSrcAccounted:     flow.CountersReply.Bytes,
-						connectionTrackingDisabled: true,
-					}
-				}
+	dumpGeneration++
+	var interestingFlowCounter, flowCounter int
+	for ns, flows := range dump.flows {
+		flowCounter += len(flows)
+		for _, flow := range flows {
+			handleDumpedFlow(ns, &flow, &interestingFlowCounter)
+		}
+	}
+	reapMissingConnections(dump.started)
+	recordDump(dump, time.Now().Sub(start))
+	Log("dump").Info("Handled dump", "interesting_flows", interestingFlowCounter, "flows", flowCounter, "duration_ms", time.Now().Sub(start).Milliseconds())
+	if FlowIDReuseCounter > 0 || CounterResetCounter > 0 || ReapedConnectionCounter > 0 || DroppedConnectionCounter > 0 {
+		Log("anomalies").Warn("Anomalies since start", "flow_id_reuses", FlowIDReuseCounter, "counter_resets", CounterResetCounter, "reaped_connections", ReapedConnectionCounter, "dropped_connections", DroppedConnectionCounter)
+	}
+	Log("dump").Info("Connection table", "connections", len(connections))
+}
+
+func handleDumpedFlow(ns int, flow *conntrack.Flow, interestingFlowCounter *int) {
+	if FlowIsInteresting(flow) {
+		*interestingFlowCounter++
+		if info, ok := lookupConnection(ns, flow); ok {
+			// We know this flow, update its stats
+			info.lastDump = dumpGeneration
+			updateStart(info, flow)
+			updateConnectionCounters(info, flow)
+			AccountTraffic(info)
+		} else {
+			// We don't know this flow, so we can only do connection tracking if the kernel tells us its start.
+			// But we can count future traffic if accounting is enabled.
+			proto := flow.TupleOrig.Proto.Protocol
+			trackable := !flow.Timestamp.Start.IsZero() && (isConnectionOriented(proto) || isPseudoConnection(proto))
+			if trackable || flow.CountersOrig.Packets != 0 || flow.CountersReply.Packets != 0 {
+				reversed := ServiceSideReversed(flow)
+				srcToDst, dstToSrc := flowCounters(flow, reversed)
+				addConnection(ConnectionID{ns, flow.ID}, &ConnectionInfo{
+					key:                        AccountingKey(ns, flow),
+					reversed:                   reversed,
+					packetsSrcToDstAccounted:   srcToDst.Packets,
+					bytesSrcToDstAccounted:     srcToDst.Bytes,
+					packetsDstToSrcAccounted:   dstToSrc.Packets,
+					bytesDstToSrcAccounted:     dstToSrc.Bytes,
+					connectionTrackingDisabled: !trackable,
+					pseudoConnection:           trackable && isPseudoConnection(proto),
+					start:                      flow.Timestamp.Start,
+					tuple:                      flow.TupleOrig,
+					kernelStart:                flow.Timestamp.Start,
+					lastDump:                   dumpGeneration,
+				})
 			}
 		}
 	}
-	log.Println("[Dump] Handled", interestingFlowCounter, "flows out of", len(dump.flows), "in", time.Now().Sub(start).Milliseconds(), "ms")
 }
 
-func handleNewFlow(flow *conntrack.Flow) {
-	connections[flow.ID] = &ConnectionInfo{
-		key:                        AccountingKey(flow),
+// Take the start of a connection from the kernel timestamp, as soon as a dump or event carries it.
+// NEW events have none, so until then the start is the time we handled the NEW event.
+func updateStart(info *ConnectionInfo, flow *conntrack.Flow) {
+	if info.kernelStart.IsZero() && !flow.Timestamp.Start.IsZero() {
+		info.kernelStart = flow.Timestamp.Start
+		info.start = flow.Timestamp.Start
+	}
+}
+
+func handleNewFlow(ns int, flow *conntrack.Flow) {
+	proto := flow.TupleOrig.Proto.Protocol
+	lookupConnection(ns, flow)
+	info := &ConnectionInfo{
+		key:                        AccountingKey(ns, flow),
+		reversed:                   ServiceSideReversed(flow),
 		start:                      time.Now(),
-		connectionTrackingDisabled: flow.TupleOrig.Proto.Protocol != PROTO_TCP && flow.TupleOrig.Proto.Protocol != PROTO_DCCP && flow.TupleOrig.Proto.Protocol != PROTO_SCTP,
+		tuple:                      flow.TupleOrig,
+		connectionTrackingDisabled: !isConnectionOriented(proto) && !isPseudoConnection(proto),
+		pseudoConnection:           isPseudoConnection(proto),
+		tcpTracked:                 TrackTCPOutcomes && proto == PROTO_TCP,
 	}
+	updateStart(info, flow)
+	addConnection(ConnectionID{ns, flow.ID}, info)
 }
 
-func handleDestroyFlow(flow *conntrack.Flow) {
-	if info, ok := connections[flow.ID]; ok {
-		delete(connections, flow.ID)
-		if flow.CountersOrig.Packets != 0 && flow.CountersOrig.Bytes != 0 {
-			info.packetsSrcToDst = flow.CountersOrig.Packets
-			info.bytesSrcToDst = flow.CountersOrig.Bytes
-		}
-		if flow.CountersReply.Packets != 0 && flow.CountersReply.Bytes != 0 {
-			info.packetsDstToSrc = flow.CountersReply.Packets
-			info.bytesDstToSrc = flow.CountersReply.Bytes
-		}
+func handleDestroyFlow(ns int, flow *conntrack.Flow) {
+	if info, ok := lookupConnection(ns, flow); ok {
+		delete(connections, ConnectionID{ns, flow.ID})
+		updateConnectionCounters(info, flow)
 		AccountTraffic(info)
+		handleTCPState(info, flow, true)
+		updateStart(info, flow)
 		if !info.connectionTrackingDisabled {
-			AccountConnectionClose(info)
+			// DESTROY events carry the kernel timestamps, if enabled
+			end := time.Now()
+			if !flow.Timestamp.Stop.IsZero() {
+				end = flow.Timestamp.Stop
+			}
+			AccountConnectionClose(info, end)
 		}
+		AccountFinalCounters(info)
 	}
 }
 
-func handleTerminateFlow(flow *conntrack.Flow) {
-	if info, ok := connections[flow.ID]; ok {
+// TCP connection closed (FIN). The connection is counted now, UPDATE events carry no counters,
+// so its size is recorded in the histograms when the DESTROY event arrives (or when it is reaped).
+func handleTerminateFlow(ns int, flow *conntrack.Flow) {
+	if info, ok := lookupConnection(ns, flow); ok {
+		handleTCPState(info, flow, false)
+		updateStart(info, flow)
 		if !info.connectionTrackingDisabled {
-			AccountConnectionClose(info)
+			info.sizePending = TrackHistograms
+			AccountConnectionClose(info, time.Now())
 		}
 	}
 }
 
-func handleConntrackEvent(event conntrack.Event) {
+func handleConntrackEvent(ns int, event conntrack.Event) {
 	switch event.Type {
 	case conntrack.EventNew:
-		handleNewFlow(event.Flow)
+		handleNewFlow(ns, event.Flow)
 	case conntrack.EventDestroy:
-		handleDestroyFlow(event.Flow)
+		handleDestroyFlow(ns, event.Flow)
 	case conntrack.EventUpdate:
 		// Check if we know this flow and should terminate it
 		if event.Flow.TupleOrig.Proto.Protocol == PROTO_TCP && event.Flow.ProtoInfo.TCP != nil {
 			state := event.Flow.ProtoInfo.TCP.State
 			if state == TCP_CONNTRACK_CLOSE_WAIT || state == TCP_CONNTRACK_LAST_ACK || state == TCP_CONNTRACK_CLOSE {
-				handleTerminateFlow(event.Flow)
+				handleTerminateFlow(ns, event.Flow)
+			} else if TrackTCPOutcomes {
+				if info, ok := lookupConnection(ns, event.Flow); ok {
+					handleTCPState(info, event.Flow, false)
+					updateStart(info, event.Flow)
+				}
 			}
 		}
 	}
 }
 
-func GetConntrackEvents() (chan conntrack.Event, chan error) {
-	conn, err := conntrack.Dial(nil)
+// Listen for conntrack events in all monitored namespaces
+func GetConntrackEvents() (chan NamespacedEvent, chan error) {
+	errorChannel := make(chan error, len(Namespaces))
+	for ns := range Namespaces {
+		go forwardConntrackEvents(ns, eventChannel, errorChannel)
+	}
+	return eventChannel, errorChannel
+}
+
+func forwardConntrackEvents(ns int, eventChannel chan NamespacedEvent, errorChannel chan error) {
+	events, errs := listenConntrackEvents(ns)
+	for {
+		select {
+		case event := <-events:
+			eventChannel <- NamespacedEvent{ns, event}
+		case err := <-errs:
+			errorChannel <- err
+			return
+		}
+	}
+}
+
+func listenConntrackEvents(ns int) (chan conntrack.Event, chan error) {
+	conn, err := DialNamespace(ns)
 	if err != nil {
-		log.Fatal(err)
+		Fatal("events", "Conntrack dial failed", "namespace", NamespaceName(ns), "err", err)
 	}
 
 	buffersize := 212992 * 128 // around 26MB - "viel hilft viel"
@@ -131,17 +314,21 @@ func GetConntrackEvents() (chan conntrack.Event, chan error) {
 			break
 		}
 	}
-	log.Println("Set read buffer size to", buffersize/1024, "KB")
+	Log("events").Info("Set read buffer size", "namespace", NamespaceName(ns), "buffer_kb", buffersize/1024)
 
 	eventChannel := make(chan conntrack.Event, 65536)
 	errorChannel, err := conn.Listen(eventChannel, 8, netfilter.GroupsCT)
 	if err != nil {
-		log.Fatal(err)
+		Fatal("events", "Conntrack listen failed", "namespace", NamespaceName(ns), "err", err)
 	}
 
-	err = conn.SetOption(netlink.ListenAllNSID, true)
-	if err != nil {
-		log.Fatal(err)
+	// Without explicit namespaces we keep receiving events from all namespaces (merged),
+	// otherwise every namespace has its own socket.
+	if !DimensionNamespace {
+		err = conn.SetOption(netlink.ListenAllNSID, true)
+		if err != nil {
+			Fatal("events", "Could not listen to all namespaces", "err", err)
+		}
 	}
 	return eventChannel, errorChannel
 }
@@ -152,32 +339,146 @@ func nextTimestamp(interval int64) int64 {
 
 type DumpResult struct {
 	Timestamp time.Time
-	flows     []conntrack.Flow
+	started   time.Time
+	flows     [][]conntrack.Flow // per namespace, nil if the dump failed
+	duration  time.Duration
+	size      int
 }
 
-func runDumping(channel chan DumpResult, timestamp int64) {
-	time.Sleep(time.Unix(timestamp, 0).Sub(time.Now()))
+// Dump at the given time, unless the dump is canceled before
+func runDumping(channel chan DumpResult, timestamp int64, cancel chan bool) {
+	timer := time.NewTimer(time.Unix(timestamp, 0).Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-cancel:
+		return
+	}
+	// from now on, the dump can not be canceled anymore
+	dumpState.Lock()
+	select {
+	case <-cancel:
+		dumpState.Unlock()
+		return
+	default:
+	}
+	dumpState.running = true
+	dumpState.cancel = nil
+	dumpState.Unlock()
 
 	start := time.Now()
+	flows := make([][]conntrack.Flow, len(Namespaces))
+	size := 0
+	for ns := range Namespaces {
+		var err error
+		flows[ns], err = dumpNamespace(ns)
+		if err != nil {
+			// without a complete dump we can't reap connections, so the whole dump is skipped
+			Log("dump").Error("Dump failed", "namespace", NamespaceName(ns), "err", err)
+			recordNetlinkError()
+			flows, size = nil, 0
+			break
+		}
+		size += len(flows[ns])
+	}
+	// Transmit
+	start2 := time.Now()
+	channel <- DumpResult{time.Unix(timestamp, 0), start, flows, start2.Sub(start), size}
+	Log("dump").Info("Received conntrack table", "entries", size, "duration_ms", time.Now().Sub(start).Milliseconds(), "transmit_ms", time.Now().Sub(start2).Milliseconds())
+}
+
+func dumpNamespace(ns int) ([]conntrack.Flow, error) {
 	// Create connection to conntrack
-	conn, err := conntrack.Dial(nil)
+	conn, err := DialNamespace(ns)
 	if err != nil {
-		log.Fatal("Conntrack dial:", err)
+		return nil, err
 	}
 	defer conn.Close()
-	// Query dumps
-	flows, err := conn.DumpFilter(conntrack.Filter{Mark: 0, Mask: 0}, &conntrack.DumpOptions{})
+	// Query dumps - the kernel only returns flows matching the connmark filter
+	flows, err := conn.DumpFilter(DumpFilter, &conntrack.DumpOptions{})
 	if err != nil {
-		log.Fatal("DumpFilter:", err)
+		return nil, err
 	}
-	// Transmit
-	start2 := time.Now()
-	channel <- DumpResult{time.Unix(timestamp, 0), flows}
-	log.Println("[Dump] Received", len(flows), "conntrack table entries in", time.Now().Sub(start).Milliseconds(), "ms (", time.Now().Sub(start2).Milliseconds(), " to transmit)")
+	return filterDumpedFlows(flows), nil
+}
+
+// Drop IPv6 flows and flows from other zones before they reach the main loop.
+// The netlink library only supports connmark filters, so this part happens in userspace.
+func filterDumpedFlows(flows []conntrack.Flow) []conntrack.Flow {
+	filtered := flows[:0]
+	for _, flow := range flows {
+		if FlowMatchesDumpFilter(&flow) {
+			filtered = append(filtered, flow)
+		}
+	}
+	return filtered
+}
+
+// The next dump, shared with the dumping goroutine. There is only one dump at a time:
+// once it has started, it runs until its result has been handled in the main loop.
+var dumpState struct {
+	sync.Mutex
+	cancel  chan bool // closed to cancel the dump that waits for its time
+	running bool      // a dump has started, its result has not been handled yet
+}
+
+// Cancel the dump that waits for its time. Returns false if a dump is running.
+func cancelDump() bool {
+	dumpState.Lock()
+	defer dumpState.Unlock()
+	if dumpState.running {
+		return false
+	}
+	if dumpState.cancel != nil {
+		close(dumpState.cancel)
+		dumpState.cancel = nil
+	}
+	return true
+}
+
+func startDumping(channel chan DumpResult, timestamp int64) {
+	cancel := make(chan bool)
+	dumpState.Lock()
+	dumpState.cancel = cancel
+	dumpState.Unlock()
+	go runDumping(channel, timestamp, cancel)
+}
+
+// Called in the main loop once the result of a dump has been handled
+func dumpFinished() {
+	dumpState.Lock()
+	defer dumpState.Unlock()
+	dumpState.running = false
+}
+
+// Schedule the next dump: at the next interval / round start, or not at all if rounds are triggered externally.
+// A dump that has been scheduled before is canceled. While a dump is running, nothing happens:
+// the next dump is scheduled after it has been handled.
+func ScheduleNextDump(channel chan DumpResult) {
+	recordDumpInterval()
+	if !cancelDump() || RoundExternal {
+		return
+	}
+	if RoundLength > 0 {
+		startDumping(channel, nextRoundTimestamp())
+		return
+	}
+	startDumping(channel, nextTimestamp(Interval))
+}
+
+// Dump (and flush) immediately, instead of the scheduled dump.
+// Returns false if a dump is already running, its flush comes next anyway.
+func DumpNow(channel chan DumpResult) bool {
+	if !cancelDump() {
+		return false
+	}
+	startDumping(channel, time.Now().Unix())
+	return true
 }
 
 func GetDumpingChannel() chan DumpResult {
+	recordDumpInterval()
 	channel := make(chan DumpResult, 1)
-	go runDumping(channel, time.Now().Unix())
+	startDumping(channel, time.Now().Unix())
 	return channel
 }
@@ -1,13 +1,14 @@
 package main
 
 // echo 1 > /proc/sys/net/netfilter/nf_conntrack_acct
+// echo 1 > /proc/sys/net/netfilter/nf_conntrack_timestamp
 
 import (
 	"flag"
+	"fmt"
 	"github.com/ti-mo/conntrack"
 	"golang.org/x/sys/unix"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/netip"
 	"os"
@@ -19,6 +20,7 @@ import (
 )
 
 const NetfilterConntrackAcctSetting = "/proc/sys/net/netfilter/nf_conntrack_acct"
+const NetfilterConntrackTimestampSetting = "/proc/sys/net/netfilter/nf_conntrack_timestamp"
 
 // 2020 we saw at most 117696 entries. That means: this pipe has a buffer for 285 bytes / entry.
 const PipeBufferSize = 32 * 1024 * 1024
@@ -43,6 +45,13 @@ var DestGroupMask = net.IPv4Mask(255, 255, 255, 255)
 var IpExcludePresent bool
 var IpExclude netip.Addr
 
+// Connmark filter, applied by the kernel when dumping (from command line)
+var DumpFilter = conntrack.Filter{Mark: 0, Mask: 0}
+
+// Only consider flows from this conntrack zone
+var DumpZonePresent bool
+var DumpZone uint16
+
 // Include ICMP?
 var ICMPInclude bool
 
@@ -58,45 +67,90 @@ var Interval int64 = 15
 // Track open connections (and output them in every interval)
 var TrackOpenConnections bool
 
+// Check if a conntrack flow passes the mark / zone / family filter.
+// Dumps are already filtered by mark in the kernel, events are not.
+func FlowMatchesDumpFilter(flow *conntrack.Flow) bool {
+	if flow.TupleOrig.IP.IsIPv6() {
+		return false
+	}
+	if flow.Mark&DumpFilter.Mask != DumpFilter.Mark {
+		return false
+	}
+	if DumpZonePresent && flow.Zone != DumpZone {
+		return false
+	}
+	return true
+}
+
+// Parse a connmark filter in the format "mark[/mask]", like the nftables / iptables mark match
+func ParseMarkFilter(s string) (conntrack.Filter, error) {
+	filter := conntrack.Filter{Mask: 0xffffffff}
+	parts := strings.SplitN(s, "/", 2)
+	mark, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return filter, err
+	}
+	if len(parts) == 2 {
+		mask, err := strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return filter, err
+		}
+		filter.Mask = uint32(mask)
+	}
+	filter.Mark = uint32(mark) & filter.Mask
+	return filter, nil
+}
+
 // Check if we should consider a conntrack flow (after src / dst filter)
 func FlowIsInteresting(flow *conntrack.Flow) bool {
-	if flow.TupleOrig.IP.IsIPv6() || (flow.TupleOrig.Proto.Protocol == PROTO_ICMP && !ICMPInclude) {
+	if !FlowMatchesDumpFilter(flow) || (flow.TupleOrig.Proto.Protocol == PROTO_ICMP && !ICMPInclude) {
 		return false
 	}
-	if IpExcludePresent && (IpExclude == flow.TupleOrig.IP.SourceAddress || IpExclude == flow.TupleOrig.IP.DestinationAddress) {
+	if IpExcludePresent && (IpExclude == SourceAddress(flow) || IpExclude == DestAddress(flow)) {
 		return false
 	}
-	if SourceFilterPresent && !SourceFilterNet.Contains(ConvertIp(flow.TupleOrig.IP.SourceAddress)) {
+	if SourceFilterPresent && !SourceFilterNet.Contains(ConvertIp(SourceAddress(flow))) {
 		return false
 	}
-	if DestFilterPresent && !DestFilterNet.Contains(ConvertIp(flow.TupleOrig.IP.DestinationAddress)) {
+	if DestFilterPresent && !DestFilterNet.Contains(ConvertIp(DestAddress(flow))) {
 		return false
 	}
 	return true
 }
 
-func EnableNetfilterTrafficAccounting() error {
-	content, err := ioutil.ReadFile(NetfilterConntrackAcctSetting)
-	if err != nil {
-		return err
-	}
-	if strings.Trim(string(content), " \n") == "0" {
-		err = ioutil.WriteFile(NetfilterConntrackAcctSetting, []byte("1"), 0644)
+// The settings belong to a network namespace, they are checked in every monitored namespace
+func enableNetfilterSetting(ns int, setting, name string) error {
+	return InNamespace(ns, func() error {
+		content, err := ioutil.ReadFile(setting)
 		if err != nil {
 			return err
 		}
-		log.Println("Enabled conntrack traffic accounting (" + NetfilterConntrackAcctSetting + " = 1)")
-		log.Println("Connections that are already open cannot be tracked.")
-	} else {
-		log.Println("Conntrack traffic accounting is already enabled.")
-	}
-	return nil
+		if strings.Trim(string(content), " \n") == "0" {
+			err = ioutil.WriteFile(setting, []byte("1"), 0644)
+			if err != nil {
+				return err
+			}
+			Log("netfilter").Info("Enabled conntrack "+name+", connections that are already open cannot be tracked", "setting", setting, "namespace", NamespaceName(ns))
+		} else {
+			Log("netfilter").Info("Conntrack "+name+" is already enabled", "setting", setting, "namespace", NamespaceName(ns))
+		}
+		return nil
+	})
+}
+
+func EnableNetfilterTrafficAccounting(ns int) error {
+	return enableNetfilterSetting(ns, NetfilterConntrackAcctSetting, "traffic accounting")
+}
+
+// With timestamps, the kernel reports exact start / stop times in dumps and DESTROY events
+func EnableNetfilterTimestamps(ns int) error {
+	return enableNetfilterSetting(ns, NetfilterConntrackTimestampSetting, "timestamps")
 }
 
 // Create a channel that delivers termination signals
 func WaitForTerminationChannel() chan os.Signal {
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	return signalChannel
 }
 
@@ -105,7 +159,12 @@ func handleAllChannels() {
 	signalChannel := WaitForTerminationChannel()
 	dumpingChannel := GetDumpingChannel()
 	portfileReloadChannel := PortFileReloadChannel()
-	log.Println("Running ...")
+	roundTriggerChannel := RoundTriggerChannel()
+	controlChannel := ControlChannel()
+	reloadSignalChannel := ReloadSignalChannel()
+	watchdogChannel := WatchdogChannel()
+	Log("main").Info("Running")
+	sdNotify("READY=1")
 	var eventCounter int
 	var interestingEventCounter int
 
@@ -113,150 +172,326 @@ func handleAllChannels() {
 		select {
 		case event := <-conntrackEventChannel:
 			eventCounter++
-			if event.Flow != nil && FlowIsInteresting(event.Flow) {
+			if event.event.Flow != nil && FlowIsInteresting(event.event.Flow) {
 				interestingEventCounter++
-				handleConntrackEvent(event)
+				recordEvent(true)
+				handleConntrackEvent(event.ns, event.event)
+			} else {
+				recordEvent(false)
 			}
 		case err := <-conntrackErrorChannel:
 			if err != nil {
-				log.Fatal("Socket error channel (events):", err)
+				Fatal("events", "Conntrack event socket failed", "err", err)
 			}
 			return
 		case sig := <-signalChannel:
-			log.Println("[Signal] Terminating with signal \"" + sig.String() + "\" ...")
+			Log("main").Info("Terminating", "signal", sig.String())
+			sdNotify("STOPPING=1")
 			if TrackOpenConnections {
 				accountOpenConnections()
 			}
 			FlushAccountingTableToOutput(time.Now())
+			CloseArchive()
 			return
-		case <-portfileReloadChannel:
-			err := PortFileReload()
+		case portfile := <-portfileReloadChannel:
+			err := portfile.Reload()
+			if err != nil {
+				Log("ports").Error("Could not load port file", "ports", portfile.name, "file", portfile.fname, "err", err)
+			}
+		case <-watchdogChannel:
+			watchdogPing()
+		case <-reloadSignalChannel:
+			err := ReloadConfiguration()
 			if err != nil {
-				log.Println("[Ports] Could not load file: ", err)
+				Log("config").Error("Could not reload configuration, keeping the old one", "err", err)
+			}
+		case request := <-controlChannel:
+			request.response <- handleControlCommand(request, dumpingChannel)
+		case <-roundTriggerChannel:
+			if TriggerRound(dumpingChannel) {
+				Log("rounds").Info("Round finished", "round", externalRound)
+			} else {
+				Log("rounds").Warn("Previous round is still being processed, ignoring trigger")
 			}
 		case dump := <-dumpingChannel:
+			dumpFinished()
+			if dump.flows != nil {
+				// failed dumps are skipped (no reaping), like in recordDump
+				lastDumpTime = dump.started
+			}
 			handleDump(dump)
-			log.Println("[Events]", interestingEventCounter, "("+strconv.Itoa(eventCounter)+") events since last update")
+			Log("events").Info("Events since last update", "interesting_events", interestingEventCounter, "events", eventCounter)
+			recordInterval(eventCounter, interestingEventCounter)
 			eventCounter = 0
 			interestingEventCounter = 0
 			if TrackOpenConnections {
 				accountOpenConnections()
 			}
 			FlushAccountingTableToOutput(dump.Timestamp)
-			go runDumping(dumpingChannel, nextTimestamp(Interval))
+			if PipeMetrics {
+				writeOutput(formatMetricsLine(dump.Timestamp))
+			}
+			finishRound()
+			applyPendingConfig()
+			ScheduleNextDump(dumpingChannel)
 		}
 	}
 }
 
 func main() {
 	var err error
-	//IPv4 only for now
-	srcfilter := flag.String("src", "", "Source network filter (CIDR notation)")
-	srcfilterMask := flag.String("src-group-mask", "255.255.255.255", "Source filter mask")
-	dstfilter := flag.String("dst", "", "Destination network filter (CIDR notation)")
-	dstfilterMask := flag.String("dst-group-mask", "255.255.255.255", "Destination filter mask")
-	excludeIP := flag.String("exclude-ip", "", "Exclude connections from or to a single IP")
-	includeICMP := flag.Bool("include-icmp", false, "Include ICMP sessions")
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		err = RunControlClient(os.Args[2:])
+		if err != nil {
+			Fatal("control", "Control command failed", "err", err)
+		}
+		return
+	}
+
+	Config.registerFlags(flag.CommandLine)
+	flag.BoolVar(&CheckConfig, "check-config", false, "Validate the configuration, print the effective configuration and exit")
+	flag.StringVar(&ConfigFile, "config", "", "Configuration file (\"name = value\" per line, names of the command line options), reloaded on SIGHUP")
+	srcAddress := flag.String("src-address", "orig", "Tuple to take the source address from: orig, reply (after NAT) or both (orig, reply as extra column)")
+	dstAddress := flag.String("dst-address", "orig", "Tuple to take the destination address and port from: orig, reply (after NAT) or both (orig, reply as extra column)")
 	pipeFile := flag.String("pipe", "", "Pipe file to use")
-	outputFolder := flag.String("output", "", "Output folder to store csv data")
-	interval := flag.Int64("interval", 15, "Output interval")
-	portFile := flag.String("ports", "", "File listing ports to track")
+	roundStart := flag.String("round-start", "", "Align output to CTF rounds starting at this time (unix timestamp or RFC3339), requires -round-length")
+	roundLength := flag.Int64("round-length", 0, "Length of a CTF round (in seconds)")
+	flag.BoolVar(&RoundExternal, "round-external", false, "CTF rounds are triggered externally with SIGUSR1")
+	flag.BoolVar(&ServiceSideAttribution, "service-side", false, "Account connections from an interesting port (e.g. callbacks) to the service side (requires -ports)")
+	srcPortMode := flag.String("src-port", "", "Add the source port as accounting dimension: exact, ports (only ports from -src-port-file) or range (well-known / registered / ephemeral)")
+	srcPortFile := flag.String("src-port-file", "", "File listing source ports to track (default: same as -ports)")
 	flag.BoolVar(&TrackOpenConnections, "track-open", false, "Track open connections")
+	flag.BoolVar(&TrackTCPOutcomes, "tcp-outcomes", false, "Count established, refused, failed, reset and timed out TCP connections")
+	flag.BoolVar(&TrackPseudoConnections, "pseudo-connections", false, "Count UDP / ICMP / UDPLite flows as pseudo-connections (separate columns)")
+	flag.BoolVar(&TrackHistograms, "histograms", false, "Record histograms of connection duration and size (written to the output folder and /metrics)")
+	flag.BoolVar(&TrafficMatrix, "matrix", false, "Write an aggregated team x team traffic matrix per service to the output folder")
+	flag.StringVar(&ControlSocket, "control", "", "Path of the control socket (e.g. "+DefaultControlSocket+")")
+	flag.BoolVar(&PipeMetrics, "pipe-metrics", false, "Write a line with internal metrics (starting with \"#metrics\") to the output after every interval")
+	flag.BoolVar(&CSVHeader, "csv-header", false, "Start csv files in the output folder and archive with a schema version line and a header row")
+	flag.StringVar(&SchemaFile, "schema-file", "", "Write the schema version and the column names of the output to this file")
+	flag.StringVar(&JSONOutput, "json", "", "Also write the output as JSON Lines (one object per row) to this file")
+	jsonTeams := flag.String("json-teams", "", "Rules for \"src_team\" / \"dst_team\" fields of the JSON output (format of -group-rules, applied to the grouped addresses)")
+	flag.StringVar(&ArchiveFolder, "archive", "", "Folder for an archive of the traffic output, one compressed csv file per period")
+	flag.DurationVar(&ArchivePeriod, "archive-period", ArchivePeriod, "Period of one archive file")
+	archiveCompression := flag.String("archive-compression", ArchiveCompression, "Compression of archive files: gzip, zstd or none")
+	flag.DurationVar(&ArchiveMaxAge, "archive-max-age", 0, "Delete archive files older than this (e.g. 96h, 0 = keep)")
+	archiveMaxSize := flag.String("archive-max-size", "0", "Delete the oldest archive files if the archive is larger than this (e.g. 20G, 0 = unlimited)")
+	flag.StringVar(&LogLevel, "log-level", LogLevel, "Log level: debug, info, warn or error")
+	flag.StringVar(&LogFormat, "log-format", LogFormat, "Log format: text or json")
+	flag.StringVar(&HTTPListen, "http", "", "Listen address of the HTTP server for metrics (e.g. :9100)")
+	flag.IntVar(&MaxKeys, "max-keys", 0, "Maximal number of output rows per interval, the keys with least traffic are folded into an \"other\" row per protocol (0 = unlimited)")
+	flag.IntVar(&MaxConnections, "max-connections", MaxConnections, "Maximal number of tracked connections (0 = unlimited)")
+	markFilter := flag.String("mark", "", "Only consider flows with this connmark (format: mark[/mask], filtered in the kernel)")
+	zoneFilter := flag.Int("zone", -1, "Only consider flows from this conntrack zone")
+	netns := flag.String("netns", "", "Comma-separated list of network namespaces to monitor (from "+NamedNetnsFolder+", \".\" is our own namespace, \"*\" all named namespaces)")
+	flag.BoolVar(&DimensionZone, "account-zone", false, "Add the conntrack zone as accounting dimension")
+	accountMark := flag.String("account-mark", "", "Add the connmark (masked with the given mask) as accounting dimension")
+	flag.BoolVar(&DimensionLabels, "account-labels", false, "Add the conntrack labels as accounting dimension")
+	markNamesFile := flag.String("mark-names", "", "File mapping connmarks to names (format: \"mark name\")")
+	labelNamesFile := flag.String("label-names", "", "File mapping conntrack label bits to names (format: \"bit name\", e.g. /etc/xtables/connlabel.conf)")
 	flag.Parse()
+	err = ConfigFileInit()
+	if err != nil {
+		Fatal("config", "Could not read config file", "file", ConfigFile, "err", err)
+	}
+	err = LoggingInit()
+	if err != nil {
+		Fatal("config", "Invalid logging configuration", "err", err)
+	}
+
+	SourceAddressMode, err = ParseAddressMode(*srcAddress)
+	if err != nil {
+		Fatal("config", "Invalid source address mode", "err", err)
+	}
+	DestAddressMode, err = ParseAddressMode(*dstAddress)
+	if err != nil {
+		Fatal("config", "Invalid destination address mode", "err", err)
+	}
 
-	if srcfilter != nil && *srcfilter != "" {
-		_, netrange, err := net.ParseCIDR(*srcfilter)
+	if markFilter != nil && *markFilter != "" {
+		DumpFilter, err = ParseMarkFilter(*markFilter)
 		if err != nil {
-			log.Fatal("Invalid src filter:", err)
+			Fatal("config", "Invalid mark filter", "err", err)
 		}
-		SourceFilterNet = *netrange
-		SourceFilterPresent = true
-		log.Printf("Source filter: %s\n", SourceFilterNet)
+		Log("config").Info("Mark filter", "mark", fmt.Sprintf("0x%x/0x%x", DumpFilter.Mark, DumpFilter.Mask))
 	}
-	if dstfilter != nil && *dstfilter != "" {
-		_, netrange, err := net.ParseCIDR(*dstfilter)
+	if zoneFilter != nil && *zoneFilter >= 0 {
+		if *zoneFilter > 0xffff {
+			Fatal("config", "Invalid zone filter", "zone", *zoneFilter)
+		}
+		DumpZone = uint16(*zoneFilter)
+		DumpZonePresent = true
+		Log("config").Info("Zone filter", "zone", DumpZone)
+	}
+
+	if accountMark != nil && *accountMark != "" {
+		mask, err := strconv.ParseUint(*accountMark, 0, 32)
+		if err != nil {
+			Fatal("config", "Invalid account-mark mask", "err", err)
+		}
+		DimensionMarkMask = uint32(mask)
+		DimensionMark = true
+	}
+	if markNamesFile != nil && *markNamesFile != "" {
+		err := MarkNamesInit(*markNamesFile)
+		if err != nil {
+			Fatal("config", "Could not read mark names file", "err", err)
+		}
+	}
+	if labelNamesFile != nil && *labelNamesFile != "" {
+		err := LabelNamesInit(*labelNamesFile)
+		if err != nil {
+			Fatal("config", "Could not read label names file", "err", err)
+		}
+	}
+
+	if netns != nil && *netns != "" {
+		err := NamespacesInit(*netns)
 		if err != nil {
-			log.Fatal("Invalid dst filter:", err)
+			Fatal("config", "Invalid network namespaces", "err", err)
+		}
+	}
+
+	if roundLength != nil && *roundLength > 0 {
+		if RoundExternal {
+			Fatal("config", "Rounds are either triggered externally or by time")
 		}
-		DestFilterNet = *netrange
-		DestFilterPresent = true
-		log.Printf("Destination filter: %s\n", DestFilterNet)
-	}
-	SourceGroupMask = net.IPMask(net.ParseIP(*srcfilterMask).To4())
-	DestGroupMask = net.IPMask(net.ParseIP(*dstfilterMask).To4())
-	if excludeIP != nil && *excludeIP != "" {
-		// IpExclude = net.ParseIP(*excludeIP)
-		IpExclude, err = netip.ParseAddr(*excludeIP)
-		IpExcludePresent = true
+		RoundStart, err = ParseRoundStart(*roundStart)
 		if err != nil {
-			log.Panicf("Cannot parse exclude ip: %s", err)
+			Fatal("config", "Invalid round start", "err", err)
 		}
-		log.Printf("Exclude IP: %s\n", IpExclude)
+		RoundLength = time.Duration(*roundLength) * time.Second
+		Log("rounds").Info("Rounds", "round_length_s", *roundLength, "round_start", RoundStart.Format(time.RFC3339))
+	} else if roundStart != nil && *roundStart != "" {
+		Fatal("config", "Round start requires a round length (-round-length)")
 	}
 
-	if includeICMP != nil {
-		ICMPInclude = *includeICMP
+	if srcPortMode != nil && *srcPortMode != "" {
+		SourcePortMode, err = ParseSourcePortMode(*srcPortMode)
+		if err != nil {
+			Fatal("config", "Invalid source port mode", "err", err)
+		}
+		if SourcePortMode == SourcePortFiltered {
+			if srcPortFile == nil || *srcPortFile == "" {
+				SourcePortFile = DestPortFile
+			} else if err := SourcePortFile.Init(*srcPortFile); err != nil {
+				Fatal("config", "Could not read source port file", "err", err)
+			}
+		}
 	}
 
-	if outputFolder != nil && *outputFolder != "" {
-		OutputFolder = *outputFolder
-		_ = os.Mkdir(OutputFolder, 0o755)
+	ArchiveCompression, err = ParseArchiveCompression(*archiveCompression)
+	if err != nil {
+		Fatal("config", "Invalid archive configuration", "err", err)
+	}
+	ArchiveMaxSize, err = ParseSize(*archiveMaxSize)
+	if err != nil {
+		Fatal("config", "Invalid archive configuration", "err", err)
+	}
+	if ArchivePeriod < time.Duration(Config.Interval)*time.Second {
+		Fatal("config", "Archive period must not be shorter than the interval", "archive_period", ArchivePeriod.String())
+	}
+
+	if *jsonTeams != "" {
+		if JSONOutput == "" {
+			Fatal("config", "Team labels require the JSON output (-json)")
+		}
+		JSONTeamRules, err = LoadGroupRules(*jsonTeams)
+		if err != nil {
+			Fatal("config", "Could not read team rules", "file", *jsonTeams, "err", err)
+		}
+	}
+
+	if CheckConfig {
+		err = CheckConfiguration(*pipeFile)
+		if err != nil {
+			Fatal("config", "Invalid configuration", "err", err)
+		}
+		PrintConfig()
+		return
+	}
+	err = ApplyConfig()
+	if err != nil {
+		Fatal("config", "Invalid configuration", "err", err)
 	}
 
 	if pipeFile != nil && *pipeFile != "" {
 		err := syscall.Mkfifo(*pipeFile, 0644)
 		if err != nil && !os.IsExist(err) {
-			log.Fatal(err)
+			Fatal("output", "Could not create pipe", "pipe", *pipeFile, "err", err)
 		}
 		isNewPipe := err == nil
 		/*defer func() {
 			err := os.Remove(*pipeFile)
 			if err != nil {
-				log.Println("Error removing pipe:", err)
+				Log("output").Error("Could not remove pipe", "err", err)
 			}
 		}()*/
 
 		Output, err = os.OpenFile(*pipeFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
 		if err != nil {
-			log.Fatal(err)
+			Fatal("output", "Could not open pipe", "pipe", *pipeFile, "err", err)
 		}
 		defer func() {
 			err := Output.Close()
 			if err != nil {
-				log.Println("Error closing output:", err)
+				Log("output").Error("Could not close output", "err", err)
 			}
 		}()
 		// Set the size of the pipe's buffer
 		if isNewPipe {
 			_, err = unix.FcntlInt(Output.Fd(), unix.F_SETPIPE_SZ, PipeBufferSize)
 			if err != nil {
-				log.Println("Could not change pipe buffer size: ", err)
+				Log("output").Warn("Could not change pipe buffer size", "err", err)
 			}
 			pipeBuffer, err := unix.FcntlInt(Output.Fd(), unix.F_GETPIPE_SZ, 0)
 			if err != nil {
-				log.Println("Could not determine pipe buffer size: ", err)
+				Log("output").Warn("Could not determine pipe buffer size", "err", err)
 			} else {
-				log.Println("Pipe buffer size: ", pipeBuffer)
+				Log("output").Info("Pipe buffer size", "buffer_bytes", pipeBuffer)
 			}
 		}
-		log.Println("Writing output to pipe \"" + *pipeFile + "\" ...")
+		Log("output").Info("Writing output to pipe", "pipe", *pipeFile)
 	}
 
-	if interval != nil && *interval > 1 {
-		Interval = *interval
+	Log("output").Info("Columns", "columns", strings.Join(CSVColumns(), ","), "schema", CSVSchemaVersion)
+	if SchemaFile != "" {
+		err := WriteSchemaFile()
+		if err != nil {
+			Fatal("output", "Could not write schema file", "file", SchemaFile, "err", err)
+		}
 	}
 
-	if portFile != nil && *portFile != "" {
-		err := PortFileInit(*portFile)
+	if ArchiveFolder != "" {
+		err := ArchiveInit()
+		if err != nil {
+			Fatal("archive", "Could not initialize archive", "folder", ArchiveFolder, "err", err)
+		}
+	}
+	if TrackHistograms {
+		HistogramsInit()
+	}
+	MetricsInit()
+	if HTTPListen != "" {
+		HealthInit()
+		HTTPServerInit()
+	}
+	if ControlSocket != "" {
+		err := ControlSocketInit()
 		if err != nil {
-			log.Fatal("Port file:", err)
+			Fatal("control", "Could not open control socket", "err", err)
 		}
 	}
 
-	err = EnableNetfilterTrafficAccounting()
-	if err != nil {
-		log.Println("Could not check or enable conntrack traffic accounting. ")
-		log.Println("Use: echo 1 > " + NetfilterConntrackAcctSetting)
+	for ns := range Namespaces {
+		err = EnableNetfilterTrafficAccounting(ns)
+		if err != nil {
+			Log("netfilter").Error("Could not check or enable conntrack traffic accounting, use: echo 1 > "+NetfilterConntrackAcctSetting+" (in the namespace)", "namespace", NamespaceName(ns), "err", err)
+		}
+		err = EnableNetfilterTimestamps(ns)
+		if err != nil {
+			Log("netfilter").Warn("Could not check or enable conntrack timestamps, connection durations will be less accurate, use: echo 1 > "+NetfilterConntrackTimestampSetting+" (in the namespace)", "namespace", NamespaceName(ns), "err", err)
+		}
 	}
 	handleAllChannels()
 }
@@ -4,8 +4,10 @@ import "strconv"
 
 const PROTO_ICMP = 1
 const PROTO_TCP = 6
+const PROTO_UDP = 17
 const PROTO_DCCP = 33
 const PROTO_SCTP = 132
+const PROTO_UDPLITE = 136
 
 const (
 	TCP_CONNTRACK_NONE        = 0
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of the control socket (from command line), empty = disabled
+var ControlSocket string
+
+const DefaultControlSocket = "/run/conntrack_accounting.sock"
+
+// A command from the control socket, handled in the main loop
+type ControlRequest struct {
+	command  string
+	args     []string
+	response chan string
+}
+
+var controlChannel = make(chan ControlRequest)
+
+var startTime = time.Now()
+var lastDumpTime time.Time // start of the last successful dump
+
+func ControlChannel() chan ControlRequest {
+	return controlChannel
+}
+
+func ControlSocketInit() error {
+	_ = os.Remove(ControlSocket)
+	listener, err := net.Listen("unix", ControlSocket)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(ControlSocket, 0600)
+	if err != nil {
+		return err
+	}
+	Log("control").Info("Listening", "socket", ControlSocket)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				Log("control").Error("Accept failed", "err", err)
+				continue
+			}
+			go handleControlConnection(conn)
+		}
+	}()
+	return nil
+}
+
+// One command per connection: the client sends a single line, we answer and close the connection
+func handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	request := ControlRequest{fields[0], fields[1:], make(chan string, 1)}
+	controlChannel <- request
+	_, _ = conn.Write([]byte(<-request.response))
+}
+
+// Execute a control command (in the main loop)
+func handleControlCommand(request ControlRequest, dumpingChannel chan DumpResult) string {
+	switch request.command {
+	case "flush-now":
+		if RoundExternal {
+			if !TriggerRound(dumpingChannel) {
+				return "error: previous round is still being processed\n"
+			}
+		} else if !DumpNow(dumpingChannel) {
+			return "ok, flushed after the dump that is already running\n"
+		}
+		return "ok\n"
+	case "reload":
+		err := ReloadConfiguration()
+		if err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		return "ok, applied after the next flush\n"
+	case "status":
+		return controlStatus()
+	case "dump-connections":
+		return controlDumpConnections()
+	case "set-interval":
+		if len(request.args) != 1 {
+			return "usage: set-interval <seconds>\n"
+		}
+		interval, err := strconv.ParseInt(request.args[0], 10, 64)
+		if err != nil || interval <= 1 {
+			return "error: invalid interval\n"
+		}
+		if RoundsEnabled() {
+			return "error: output is aligned to rounds\n"
+		}
+		Interval = interval
+		Config.Interval = interval
+		ScheduleNextDump(dumpingChannel)
+		Log("control").Info("Interval changed", "interval_s", Interval)
+		return "ok\n"
+	case "top":
+		n := 10
+		if len(request.args) > 0 {
+			var err error
+			n, err = strconv.Atoi(request.args[0])
+			if err != nil || n <= 0 {
+				return "usage: top [n]\n"
+			}
+		}
+		return controlTop(n)
+	case "explain":
+		if len(request.args) != 1 {
+			return "usage: explain <ip>\n"
+		}
+		return ExplainAddress(request.args[0])
+	case "help":
+		return "commands: flush-now, reload, status, dump-connections, set-interval <seconds>, top [n], explain <ip>\n"
+	}
+	return "error: unknown command \"" + request.command + "\" (try help)\n"
+}
+
+func controlStatus() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "uptime: %s\n", time.Now().Sub(startTime).Round(time.Second))
+	if RoundsEnabled() {
+		fmt.Fprintf(&out, "round: %d\n", RoundNumber(time.Now()))
+	} else {
+		fmt.Fprintf(&out, "interval: %d s\n", Interval)
+	}
+	if !lastDumpTime.IsZero() {
+		fmt.Fprintf(&out, "last dump: %s (%s ago)\n", lastDumpTime.Format(time.RFC3339), time.Now().Sub(lastDumpTime).Round(time.Second))
+	}
+	fmt.Fprintf(&out, "namespaces: %s\n", strings.Join(NamespaceNames(), ", "))
+	fmt.Fprintf(&out, "connections: %d\n", len(connections))
+	fmt.Fprintf(&out, "accounting table: %d entries\n", len(AccountingTable))
+	fmt.Fprintf(&out, "flow ID reuses: %d\n", FlowIDReuseCounter)
+	fmt.Fprintf(&out, "counter resets: %d\n", CounterResetCounter)
+	fmt.Fprintf(&out, "reaped connections: %d\n", ReapedConnectionCounter)
+	fmt.Fprintf(&out, "dropped connections: %d\n", DroppedConnectionCounter)
+	if MaxKeys > 0 {
+		fmt.Fprintf(&out, "folded keys (current interval): %d\n", FoldedKeyCounter)
+	}
+	return out.String()
+}
+
+// format: namespace,id,proto,src,dst,port,packets_src,packets_dst,bytes_src,bytes_dst,tracked,start[,dimensions]
+func controlDumpConnections() string {
+	var out strings.Builder
+	for id, info := range connections {
+		start := "-"
+		if !info.start.IsZero() {
+			start = info.start.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&out, "%s,%d,%s,%d,%d,%d,%d,%t,%s%s\n", NamespaceName(id.ns), id.id, info.key.key,
+			info.packetsSrcToDst, info.packetsDstToSrc, info.bytesSrcToDst, info.bytesDstToSrc,
+			!info.connectionTrackingDisabled, start, info.key.dimensions)
+	}
+	return out.String()
+}
+
+// The n keys with most traffic in the current interval
+func controlTop(n int) string {
+	entries := make([]*AccountingEntry, 0, len(AccountingTable))
+	for _, entry := range AccountingTable {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].bytesSrcToDst+entries[i].bytesDstToSrc > entries[j].bytesSrcToDst+entries[j].bytesDstToSrc
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	var out strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&out, "%s%s: %d bytes, %d packets, %d connections\n", entry.key.key, entry.key.dimensions,
+			entry.bytesSrcToDst+entry.bytesDstToSrc, entry.packetsSrcToDst+entry.packetsDstToSrc, entry.connectionCount)
+	}
+	return out.String()
+}
+
+// Client for the control socket: conntrack_accounting ctl [-control=<socket>] <command> [args...]
+func RunControlClient(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("control", DefaultControlSocket, "Control socket")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: conntrack_accounting ctl [-control=<socket>] <command> [args...] (try help)")
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(flags.Args(), " ") + "\n"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
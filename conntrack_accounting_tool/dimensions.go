@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/ti-mo/conntrack"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Additional (optional) accounting dimensions, appended to each output row (from command line)
+var DimensionZone bool
+var DimensionMark bool
+var DimensionMarkMask uint32 = 0xffffffff
+var DimensionLabels bool
+
+// Source port dimension
+const (
+	SourcePortNone     = 0
+	SourcePortExact    = 1 // port number
+	SourcePortFiltered = 2 // port number if listed in the source port file, -1 otherwise
+	SourcePortRange    = 3 // well-known / registered / ephemeral
+)
+
+var SourcePortMode = SourcePortNone
+
+// Readable names for marks and label bits
+var markNames = make(map[uint32]string)
+var labelNames = make(map[int]string)
+
+// AccountingDimensions returns the optional key columns of a flow, each prefixed with ","
+func AccountingDimensions(ns int, flow *conntrack.Flow) string {
+	var s strings.Builder
+	if DimensionNamespace {
+		s.WriteString(",")
+		s.WriteString(NamespaceName(ns))
+	}
+	if DimensionZone {
+		s.WriteString(",")
+		s.WriteString(strconv.FormatUint(uint64(flow.Zone), 10))
+	}
+	if DimensionMark {
+		s.WriteString(",")
+		s.WriteString(MarkName(flow.Mark & DimensionMarkMask))
+	}
+	if DimensionLabels {
+		s.WriteString(",")
+		s.WriteString(LabelNames(flow.Labels))
+	}
+	if SourcePortMode != SourcePortNone {
+		s.WriteString(",")
+		s.WriteString(SourcePortName(flow))
+	}
+	if SourceAddressMode == AddressBoth {
+		s.WriteString(",")
+		s.WriteString(GroupAddress(sourceAddressReply(flow), SourceGroupMask))
+	}
+	if DestAddressMode == AddressBoth {
+		s.WriteString(",")
+		s.WriteString(GroupAddress(destAddressReply(flow), DestGroupMask))
+	}
+	if ServiceSideAttribution {
+		s.WriteString(",")
+		s.WriteString(DirectionName(ServiceSideReversed(flow)))
+	}
+	return s.String()
+}
+
+// DimensionNames returns the column names of the optional key columns, in output order
+func DimensionNames() []string {
+	var names []string
+	if DimensionNamespace {
+		names = append(names, "namespace")
+	}
+	if DimensionZone {
+		names = append(names, "zone")
+	}
+	if DimensionMark {
+		names = append(names, "mark")
+	}
+	if DimensionLabels {
+		names = append(names, "labels")
+	}
+	if SourcePortMode != SourcePortNone {
+		names = append(names, "src_port")
+	}
+	if SourceAddressMode == AddressBoth {
+		names = append(names, "src_reply")
+	}
+	if DestAddressMode == AddressBoth {
+		names = append(names, "dst_reply")
+	}
+	if ServiceSideAttribution {
+		names = append(names, "direction")
+	}
+	return names
+}
+
+func ParseSourcePortMode(s string) (int, error) {
+	switch s {
+	case "exact":
+		return SourcePortExact, nil
+	case "ports":
+		return SourcePortFiltered, nil
+	case "range":
+		return SourcePortRange, nil
+	}
+	return SourcePortNone, errors.New("Invalid source port mode (exact/ports/range): " + s)
+}
+
+// Name of the client side port: the source port, or the destination port of flows accounted to the service side
+func SourcePortName(flow *conntrack.Flow) string {
+	port := SourcePort(flow)
+	if ServiceSideReversed(flow) {
+		port = DestPort(flow)
+	}
+	switch SourcePortMode {
+	case SourcePortFiltered:
+		if !SourcePortFile.PortIsInteresting(ProtoLookup(flow.TupleOrig.Proto.Protocol), port) {
+			return "-1"
+		}
+	case SourcePortRange:
+		if port < 1024 {
+			return "well-known"
+		} else if port < 32768 {
+			return "registered"
+		}
+		return "ephemeral"
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+func MarkName(mark uint32) string {
+	if name, ok := markNames[mark]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(mark), 10)
+}
+
+// LabelNames formats all label bits set on a flow, joined by "+" ("-" if there are none).
+// The kernel transfers labels as an array of native-endian longs, we assume little endian here.
+func LabelNames(labels []byte) string {
+	var names []string
+	for i, b := range labels {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				label := i*8 + bit
+				if name, ok := labelNames[label]; ok {
+					names = append(names, name)
+				} else {
+					names = append(names, strconv.Itoa(label))
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "+")
+}
+
+// Read a mapping file with lines in the format "<number> <name>" (like /etc/xtables/connlabel.conf)
+func readNamesFile(fname string) (map[uint64]string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	names := make(map[uint64]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid line (not format \"number name\"): " + line)
+		}
+		if strings.ContainsAny(fields[1], ",+") {
+			return nil, errors.New("Invalid name (must not contain \",\" or \"+\"): " + fields[1])
+		}
+		number, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		names[number] = fields[1]
+	}
+	return names, scanner.Err()
+}
+
+func MarkNamesInit(fname string) error {
+	names, err := readNamesFile(fname)
+	if err != nil {
+		return err
+	}
+	for number, name := range names {
+		markNames[uint32(number)] = name
+	}
+	Log("dimensions").Info("Loaded mark names", "file", fname, "names", len(names))
+	return nil
+}
+
+func LabelNamesInit(fname string) error {
+	names, err := readNamesFile(fname)
+	if err != nil {
+		return err
+	}
+	for number, name := range names {
+		if number >= 128 {
+			return errors.New("Invalid label bit: " + strconv.FormatUint(number, 10))
+		}
+		labelNames[int(number)] = name
+	}
+	Log("dimensions").Info("Loaded label names", "file", fname, "names", len(names))
+	return nil
+}
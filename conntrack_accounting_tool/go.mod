@@ -1,9 +1,10 @@
 module conntrack_accounting
 
-go 1.17
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/klauspost/compress v1.17.4
 	github.com/mdlayher/netlink v1.7.2
 	github.com/ti-mo/conntrack v0.5.0
 	github.com/ti-mo/netfilter v0.5.1
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/bits"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rules to map addresses to groups (from -group-rules), the first matching rule is used.
+// Addresses without matching rule are masked with -src-group-mask / -dst-group-mask.
+// Format, one rule per line: "<cidr> <transform> <argument>" with transforms
+//
+//	mask <mask>          like the group masks, e.g. "10.32.0.0/11 mask 255.239.255.0"
+//	prefix <length>      e.g. "10.32.250.0/24 prefix 24"
+//	team <expression>    "team<N>", N computed from octet1..octet4, e.g. "10.32.0.0/11 team (octet2 & 0x10)*200 + octet3"
+//	label <name>         a fixed label, e.g. "10.32.250.0/24 label gamemaster"
+var GroupRules []*GroupRule
+
+type GroupRule struct {
+	text      string // for explain
+	network   netip.Prefix
+	transform string
+	mask      net.IPMask
+	prefixLen int
+	expr      ast.Expr
+	label     string
+}
+
+// Group label of an address: first matching rule, or the given mask
+func GroupAddress(addr netip.Addr, mask net.IPMask) string {
+	for _, rule := range GroupRules {
+		if rule.network.Contains(addr) {
+			if label, err := rule.Label(addr); err == nil {
+				return label
+			}
+		}
+	}
+	return ConvertIp(addr).Mask(mask).String()
+}
+
+func (rule *GroupRule) Label(addr netip.Addr) (string, error) {
+	switch rule.transform {
+	case "mask":
+		return ConvertIp(addr).Mask(rule.mask).String(), nil
+	case "prefix":
+		prefix, err := addr.Prefix(rule.prefixLen)
+		return prefix.Addr().String(), err
+	case "team":
+		id, err := evalGroupExpression(rule.expr, addr.As4())
+		return "team" + strconv.FormatInt(id, 10), err
+	}
+	return rule.label, nil
+}
+
+// Explain how an address is grouped (control command "explain")
+func ExplainAddress(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Is4() {
+		return "error: not an IPv4 address: " + s + "\n"
+	}
+	var out strings.Builder
+	for i, rule := range GroupRules {
+		if !rule.network.Contains(addr) {
+			continue
+		}
+		label, err := rule.Label(addr)
+		if err != nil {
+			out.WriteString("rule " + strconv.Itoa(i+1) + " (" + rule.text + ") matched, but failed: " + err.Error() + "\n")
+			continue
+		}
+		out.WriteString("rule " + strconv.Itoa(i+1) + " (" + rule.text + ") -> " + label + "\n")
+		return out.String()
+	}
+	out.WriteString("no rule matched\n")
+	out.WriteString("src-group-mask " + net.IP(SourceGroupMask).String() + describeMask(SourceGroupMask) + " -> " + ConvertIp(addr).Mask(SourceGroupMask).String() + "\n")
+	out.WriteString("dst-group-mask " + net.IP(DestGroupMask).String() + describeMask(DestGroupMask) + " -> " + ConvertIp(addr).Mask(DestGroupMask).String() + "\n")
+	return out.String()
+}
+
+// Explain non-contiguous masks like 255.239.255.0, which fold several address ranges together
+func describeMask(mask net.IPMask) string {
+	if _, size := mask.Size(); size != 0 {
+		return ""
+	}
+	inverse := make(net.IP, len(mask))
+	folded := 0
+	for i := range mask {
+		inverse[i] = ^mask[i]
+		folded += bits.OnesCount8(^mask[i])
+	}
+	return " (non-contiguous, addresses differing only in " + inverse.String() + " are one group, " + strconv.Itoa(1<<folded) + " addresses per group)"
+}
+
+func LoadGroupRules(fname string) ([]*GroupRule, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []*GroupRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		rule, err := parseGroupRule(line)
+		if err != nil {
+			return nil, errors.New("Invalid rule \"" + line + "\": " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseGroupRule(line string) (*GroupRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, errors.New("format is \"<cidr> <transform> <argument>\"")
+	}
+	// the argument is the rest of the line (team expressions may contain whitespace)
+	rest := strings.TrimSpace(line)
+	for _, field := range fields[:2] {
+		rest = strings.TrimLeft(strings.TrimPrefix(rest, field), " \t")
+	}
+	network, err := netip.ParsePrefix(fields[0])
+	if err != nil || !network.Addr().Is4() {
+		return nil, errors.New("invalid IPv4 network")
+	}
+	rule := &GroupRule{text: line, network: network.Masked(), transform: fields[1]}
+	argument := strings.TrimSpace(rest)
+	switch rule.transform {
+	case "mask":
+		rule.mask, err = parseGroupMask(argument)
+	case "prefix":
+		rule.prefixLen, err = strconv.Atoi(argument)
+		if err == nil && (rule.prefixLen < 0 || rule.prefixLen > 32) {
+			err = errors.New("prefix length must be between 0 and 32")
+		}
+	case "team":
+		rule.expr, err = parser.ParseExpr(argument)
+		if err == nil {
+			err = checkGroupExpression(rule.expr)
+		}
+	case "label":
+		rule.label = argument
+		if strings.ContainsAny(argument, ", \t\"") {
+			err = errors.New("label must not contain commas, quotes or whitespace")
+		}
+	default:
+		err = errors.New("unknown transform \"" + rule.transform + "\" (mask, prefix, team or label)")
+	}
+	return rule, err
+}
+
+// Only integers, octet1..octet4, parentheses and integer operators are allowed
+func checkGroupExpression(expr ast.Expr) error {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT {
+			return errors.New("only integer literals are allowed")
+		}
+		_, err := strconv.ParseInt(e.Value, 0, 64)
+		return err
+	case *ast.Ident:
+		if _, ok := octetIndex(e.Name); !ok {
+			return errors.New("unknown variable \"" + e.Name + "\" (octet1 to octet4)")
+		}
+		return nil
+	case *ast.ParenExpr:
+		return checkGroupExpression(e.X)
+	case *ast.UnaryExpr:
+		if e.Op != token.SUB && e.Op != token.ADD {
+			return errors.New("operator " + e.Op.String() + " is not allowed")
+		}
+		return checkGroupExpression(e.X)
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM, token.AND, token.OR, token.XOR, token.SHL, token.SHR:
+		default:
+			return errors.New("operator " + e.Op.String() + " is not allowed")
+		}
+		if err := checkGroupExpression(e.X); err != nil {
+			return err
+		}
+		return checkGroupExpression(e.Y)
+	}
+	return errors.New("unsupported expression")
+}
+
+func octetIndex(name string) (int, bool) {
+	switch name {
+	case "octet1":
+		return 0, true
+	case "octet2":
+		return 1, true
+	case "octet3":
+		return 2, true
+	case "octet4":
+		return 3, true
+	}
+	return 0, false
+}
+
+// Evaluate a checked expression
+func evalGroupExpression(expr ast.Expr, octets [4]byte) (int64, error) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		return strconv.ParseInt(e.Value, 0, 64)
+	case *ast.Ident:
+		i, _ := octetIndex(e.Name)
+		return int64(octets[i]), nil
+	case *ast.ParenExpr:
+		return evalGroupExpression(e.X, octets)
+	case *ast.UnaryExpr:
+		x, err := evalGroupExpression(e.X, octets)
+		if e.Op == token.SUB {
+			x = -x
+		}
+		return x, err
+	case *ast.BinaryExpr:
+		x, err := evalGroupExpression(e.X, octets)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evalGroupExpression(e.Y, octets)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO, token.REM:
+			if y == 0 {
+				return 0, errors.New("division by zero")
+			}
+			if e.Op == token.QUO {
+				return x / y, nil
+			}
+			return x % y, nil
+		case token.AND:
+			return x & y, nil
+		case token.OR:
+			return x | y, nil
+		case token.XOR:
+			return x ^ y, nil
+		case token.SHL, token.SHR:
+			if y < 0 || y > 63 {
+				return 0, errors.New("invalid shift")
+			}
+			if e.Op == token.SHL {
+				return x << uint(y), nil
+			}
+			return x >> uint(y), nil
+		}
+	}
+	return 0, errors.New("unsupported expression")
+}
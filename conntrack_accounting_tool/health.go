@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The event channel counts as saturated above this fill level
+const EventChannelSaturation = 0.9
+
+// Reasons why the main loop makes no progress, empty if it is alive. Only these stop the watchdog pings,
+// a restart loses all tracked connections.
+func livenessProblems() []string {
+	var problems []string
+	metrics.Lock()
+	lastDump, interval := metrics.lastDump, metrics.dumpInterval
+	metrics.Unlock()
+
+	// in external round mode, dumps only happen on triggers
+	if interval > 0 {
+		if lastDump.IsZero() {
+			lastDump = startTime
+		}
+		if since := time.Now().Sub(lastDump); since > 2*interval {
+			problems = append(problems, "no dump completed for "+since.Round(time.Second).String())
+		}
+	}
+	return problems
+}
+
+// Reasons why the tool is unhealthy, empty if healthy. Output errors are reported here only,
+// they are logged and counted, and a restart would not fix them.
+func healthProblems() []string {
+	problems := livenessProblems()
+	metrics.Lock()
+	failedFlushes := metrics.failedFlushes
+	metrics.Unlock()
+
+	if eventChannel != nil && float64(len(eventChannel)) >= EventChannelSaturation*float64(cap(eventChannel)) {
+		problems = append(problems, "event channel saturated ("+strconv.Itoa(len(eventChannel))+" / "+strconv.Itoa(cap(eventChannel))+")")
+	}
+	if failedFlushes > 0 {
+		problems = append(problems, "last flush failed ("+strconv.Itoa(failedFlushes)+" in a row)")
+	}
+	return problems
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	problems := healthProblems()
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(strings.Join(problems, "\n") + "\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Ready after the first dump has been processed
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	ready := !metrics.lastDump.IsZero()
+	metrics.Unlock()
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("waiting for the first dump\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func HealthInit() {
+	httpMux.HandleFunc("/healthz", handleHealthz)
+	httpMux.HandleFunc("/readyz", handleReadyz)
+}
+
+// Send a state to systemd (sd_notify protocol), if we run as a notify service
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		Log("systemd").Error("Notify failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		Log("systemd").Error("Notify failed", "err", err)
+	}
+}
+
+// Create a channel that ticks at half the systemd watchdog timeout (never ticks without watchdog)
+func WatchdogChannel() <-chan time.Time {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	Log("systemd").Info("Watchdog enabled", "timeout_ms", usec/1000)
+	return time.NewTicker(time.Duration(usec) * time.Microsecond / 2).C
+}
+
+// Ping the watchdog from the main loop, unless dumps are stuck
+func watchdogPing() {
+	problems := livenessProblems()
+	if len(problems) > 0 {
+		Log("systemd").Warn("Dumps are stuck, not pinging the watchdog", "problems", strings.Join(problems, ", "))
+		return
+	}
+	sdNotify("WATCHDOG=1")
+}
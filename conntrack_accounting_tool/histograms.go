@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record histograms of connection duration and size (from command line)
+var TrackHistograms bool
+
+// Log-scale bucket bounds (factor 4), the last bucket (+Inf) is implicit
+var DurationBuckets = []uint64{1, 4, 16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}                    // ms
+var SizeBuckets = []uint64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864, 268435456, 1073741824} // bytes
+
+const HistogramBucketCount = 14
+
+type Histogram struct {
+	buckets [HistogramBucketCount]uint64 // not cumulative
+	count   uint64
+	sum     uint64
+}
+
+func (h *Histogram) Observe(bounds []uint64, value uint64) {
+	i := sort.Search(len(bounds), func(i int) bool { return value <= bounds[i] })
+	h.buckets[i]++
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) Add(other *Histogram) {
+	for i := range h.buckets {
+		h.buckets[i] += other.buckets[i]
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// Duration and size histogram of a key
+type ConnectionHistograms struct {
+	duration, size Histogram
+}
+
+// Cumulative histograms since start per protocol and port ("proto,port"), exported to Prometheus.
+// Per key, there would be one series per address pair ever seen.
+var cumulativeHistograms = make(map[string]*ConnectionHistograms)
+var cumulativeHistogramsLock sync.Mutex
+
+func ObserveConnection(entry *AccountingEntry, duration int64, bytes uint64) {
+	if entry.histograms == nil {
+		entry.histograms = &ConnectionHistograms{}
+	}
+	if duration < 0 {
+		duration = 0
+	}
+	entry.histograms.duration.Observe(DurationBuckets, uint64(duration))
+	entry.histograms.size.Observe(SizeBuckets, bytes)
+}
+
+// Write the histograms of one interval to a separate csv file and add them to the cumulative histograms.
+// format: time,proto,src,dst,port,histogram,count,sum,bucket_0,...,bucket_13[,dimensions...]
+func FlushHistograms(timestamp time.Time, table map[FlowKey]*AccountingEntry) {
+	var f *os.File
+	var err error
+	if OutputFolder != "" {
+		fname := filepath.Join(OutputFolder, "histograms_"+timestamp.Format("2006-01-02T15_04_05")+".csv")
+		f, err = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			Log("output").Error("Could not open csv file", "err", err)
+			recordSinkError()
+			f = nil
+		} else {
+			defer f.Close()
+		}
+	}
+
+	cumulativeHistogramsLock.Lock()
+	defer cumulativeHistogramsLock.Unlock()
+	for key, entry := range table {
+		if entry.histograms == nil {
+			continue
+		}
+		cumulative := cumulativeHistograms[histogramKey(key)]
+		if cumulative == nil {
+			cumulative = &ConnectionHistograms{}
+			cumulativeHistograms[histogramKey(key)] = cumulative
+		}
+		cumulative.duration.Add(&entry.histograms.duration)
+		cumulative.size.Add(&entry.histograms.size)
+
+		if f != nil {
+			_, err := f.WriteString(formatHistogramLine(timestamp, key, "duration", &entry.histograms.duration) +
+				formatHistogramLine(timestamp, key, "bytes", &entry.histograms.size))
+			if err != nil {
+				Log("output").Error("Write error (file)", "err", err)
+				recordSinkError()
+				f = nil
+			}
+		}
+	}
+}
+
+func formatHistogramLine(timestamp time.Time, key FlowKey, name string, h *Histogram) string {
+	var line strings.Builder
+	line.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	line.WriteString(",")
+	line.WriteString(key.key)
+	line.WriteString(",")
+	line.WriteString(name)
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(h.count, 10))
+	line.WriteString(",")
+	line.WriteString(strconv.FormatUint(h.sum, 10))
+	for _, count := range h.buckets {
+		line.WriteString(",")
+		line.WriteString(strconv.FormatUint(count, 10))
+	}
+	line.WriteString(key.dimensions)
+	line.WriteString("\n")
+	return line.String()
+}
+
+// Key of the cumulative histograms: "proto,port"
+func histogramKey(key FlowKey) string {
+	values := strings.Split(key.key, ",")
+	return values[0] + "," + values[3]
+}
+
+// Prometheus labels of a cumulative histogram
+func prometheusLabels(key string) string {
+	values := strings.Split(key, ",")
+	return "proto=" + strconv.Quote(values[0]) + ",port=" + strconv.Quote(values[1])
+}
+
+func writePrometheusHistogram(w *strings.Builder, name, labels string, bounds []uint64, h *Histogram, scale float64) {
+	var cumulative uint64
+	for i, count := range h.buckets {
+		cumulative += count
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(float64(bounds[i])/scale, 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(float64(h.sum)/scale, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func writePrometheusHistograms(out *strings.Builder) {
+	cumulativeHistogramsLock.Lock()
+	defer cumulativeHistogramsLock.Unlock()
+	out.WriteString("# HELP conntrack_connection_duration_seconds Duration of closed connections.\n")
+	out.WriteString("# TYPE conntrack_connection_duration_seconds histogram\n")
+	for key, histograms := range cumulativeHistograms {
+		writePrometheusHistogram(out, "conntrack_connection_duration_seconds", prometheusLabels(key), DurationBuckets, &histograms.duration, 1000)
+	}
+	out.WriteString("# HELP conntrack_connection_size_bytes Traffic (both directions) of closed connections.\n")
+	out.WriteString("# TYPE conntrack_connection_size_bytes histogram\n")
+	for key, histograms := range cumulativeHistograms {
+		writePrometheusHistogram(out, "conntrack_connection_size_bytes", prometheusLabels(key), SizeBuckets, &histograms.size, 1)
+	}
+}
+
+func HistogramsInit() {
+	RegisterPrometheusMetrics(writePrometheusHistograms)
+}
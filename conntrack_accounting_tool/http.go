@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Address of the HTTP server (from command line), empty = disabled
+var HTTPListen string
+
+var httpMux = http.NewServeMux()
+
+// Functions writing metrics in Prometheus text format, served on /metrics
+var prometheusWriters []func(out *strings.Builder)
+
+func RegisterPrometheusMetrics(writer func(out *strings.Builder)) {
+	prometheusWriters = append(prometheusWriters, writer)
+}
+
+func handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	var out strings.Builder
+	for _, writer := range prometheusWriters {
+		writer(&out)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(out.String()))
+}
+
+func HTTPServerInit() {
+	httpMux.HandleFunc("/metrics", handlePrometheusMetrics)
+	go func() {
+		Log("http").Info("Listening", "address", HTTPListen)
+		err := http.ListenAndServe(HTTPListen, httpMux)
+		if err != nil {
+			Fatal("http", "HTTP server failed", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON Lines output (from command line): one object per row, appended to this file after every interval.
+// The file is reopened every interval, so it can be rotated.
+var JSONOutput string
+
+// Rules for the optional "src_team" / "dst_team" fields (from command line, format of -group-rules),
+// applied to the grouped addresses
+var JSONTeamRules []*GroupRule
+
+// Team label of a grouped address, false if no rule matches (or the group is no address)
+func teamLabel(group string) (string, bool) {
+	addr, err := netip.ParseAddr(group)
+	if err != nil {
+		return "", false
+	}
+	for _, rule := range JSONTeamRules {
+		if rule.network.Contains(addr) {
+			label, err := rule.Label(addr)
+			return label, err == nil
+		}
+	}
+	return "", false
+}
+
+type jsonObject struct {
+	strings.Builder
+}
+
+func (o *jsonObject) field(name string) {
+	if o.Len() == 0 {
+		o.WriteString("{\"")
+	} else {
+		o.WriteString(",\"")
+	}
+	o.WriteString(name)
+	o.WriteString("\":")
+}
+
+func (o *jsonObject) StringField(name, value string) {
+	o.field(name)
+	quoted, _ := json.Marshal(value)
+	o.Write(quoted)
+}
+
+func (o *jsonObject) IntField(name string, value int64) {
+	o.field(name)
+	o.WriteString(strconv.FormatInt(value, 10))
+}
+
+func (o *jsonObject) UintField(name string, value uint64) {
+	o.field(name)
+	o.WriteString(strconv.FormatUint(value, 10))
+}
+
+// One row as JSON object, with the names of the csv columns. Counters and the port are numbers,
+// dimensions are strings. Optional fields are present if enabled, like the csv columns.
+func formatJSONLine(timestamp time.Time, key FlowKey, entry *AccountingEntry, round int) string {
+	var o jsonObject
+	o.StringField("time", timestamp.UTC().Format(time.RFC3339Nano))
+	o.IntField("time_ns", timestamp.UnixNano())
+	// key format: proto,src,dst,port
+	parts := strings.SplitN(key.key, ",", 4)
+	port, _ := strconv.ParseInt(parts[3], 10, 64)
+	o.StringField("proto", parts[0])
+	o.StringField("src", parts[1])
+	o.StringField("dst", parts[2])
+	o.IntField("port", port)
+	if len(JSONTeamRules) > 0 {
+		if team, ok := teamLabel(parts[1]); ok {
+			o.StringField("src_team", team)
+		}
+		if team, ok := teamLabel(parts[2]); ok {
+			o.StringField("dst_team", team)
+		}
+	}
+	o.UintField("packets_src", entry.packetsSrcToDst)
+	o.UintField("packets_dst", entry.packetsDstToSrc)
+	o.UintField("bytes_src", entry.bytesSrcToDst)
+	o.UintField("bytes_dst", entry.bytesDstToSrc)
+	o.IntField("connection_count", int64(entry.connectionCount))
+	o.IntField("connection_time", entry.connectionTime)
+	if TrackOpenConnections {
+		o.IntField("open_connections", int64(entry.openConnections))
+	}
+	if TrackTCPOutcomes {
+		o.IntField("tcp_established", int64(entry.tcpEstablished))
+		o.IntField("tcp_refused", int64(entry.tcpOutcomes[TCPOutcomeRefused]))
+		o.IntField("tcp_handshake_failed", int64(entry.tcpOutcomes[TCPOutcomeHandshakeFailed]))
+		o.IntField("tcp_reset", int64(entry.tcpOutcomes[TCPOutcomeReset]))
+		o.IntField("tcp_timeout", int64(entry.tcpOutcomes[TCPOutcomeTimeout]))
+	}
+	if TrackPseudoConnections {
+		o.IntField("pseudo_connection_count", int64(entry.pseudoConnectionCount))
+		o.IntField("pseudo_connection_time", entry.pseudoConnectionTime)
+	}
+	if key.dimensions != "" {
+		values := strings.Split(key.dimensions[1:], ",")
+		for i, name := range DimensionNames() {
+			if i < len(values) {
+				o.StringField(name, values[i])
+			}
+		}
+	}
+	if RoundsEnabled() {
+		o.IntField("round", int64(round))
+	}
+	o.WriteString("}\n")
+	return o.String()
+}
+
+// Append the rows of one interval to the JSON Lines file
+func WriteJSONOutput(data string) {
+	f, err := os.OpenFile(JSONOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Log("output").Error("Could not open json file", "file", JSONOutput, "err", err)
+		recordSinkError()
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	if err != nil {
+		Log("output").Error("Write error (json)", "file", JSONOutput, "err", err)
+		recordSinkError()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Write an aggregated team x team matrix per service in every interval (from command line)
+var TrafficMatrix bool
+
+// Row of the traffic matrix: "proto,port,src,dst"
+type MatrixEntry struct {
+	packets, bytes uint64
+	connections    int
+}
+
+// Aggregate the accounting table (both directions, all dimensions) and write it to the output folder.
+// format: time,proto,port,src,dst,packets,bytes,connections
+func FlushTrafficMatrix(timestamp time.Time, table map[FlowKey]*AccountingEntry) {
+	matrix := make(map[string]*MatrixEntry)
+	for key, entry := range table {
+		// key: proto,src,dst,port
+		parts := strings.SplitN(key.key, ",", 4)
+		matrixKey := parts[0] + "," + parts[3] + "," + parts[1] + "," + parts[2]
+		row := matrix[matrixKey]
+		if row == nil {
+			row = &MatrixEntry{}
+			matrix[matrixKey] = row
+		}
+		row.packets += entry.packetsSrcToDst + entry.packetsDstToSrc
+		row.bytes += entry.bytesSrcToDst + entry.bytesDstToSrc
+		row.connections += entry.connectionCount
+	}
+
+	fname := filepath.Join(OutputFolder, "matrix_"+timestamp.Format("2006-01-02T15_04_05")+".csv")
+	f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Log("output").Error("Could not open csv file", "err", err)
+		recordSinkError()
+		return
+	}
+	defer f.Close()
+
+	ts := strconv.FormatInt(timestamp.UnixNano(), 10)
+	var out strings.Builder
+	for matrixKey, row := range matrix {
+		out.WriteString(ts)
+		out.WriteString(",")
+		out.WriteString(matrixKey)
+		out.WriteString(",")
+		out.WriteString(strconv.FormatUint(row.packets, 10))
+		out.WriteString(",")
+		out.WriteString(strconv.FormatUint(row.bytes, 10))
+		out.WriteString(",")
+		out.WriteString(strconv.Itoa(row.connections))
+		out.WriteString("\n")
+	}
+	_, err = f.WriteString(out.String())
+	if err != nil {
+		Log("output").Error("Write error (file)", "err", err)
+		recordSinkError()
+	}
+}
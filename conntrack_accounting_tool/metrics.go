@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Write a metrics line ("#metrics <time>,name=value,...") to the output after every flush (from command line).
+// Lines start with "#", so CSV consumers can skip them as comments.
+var PipeMetrics bool
+
+// Internal metrics of the tool. Counters are updated atomically, everything else under the mutex
+// (once per interval, in the main loop), because /metrics is served from another goroutine.
+var metrics struct {
+	events            uint64
+	interestingEvents uint64
+	sinkErrors        uint64
+	netlinkErrors     uint64
+
+	sync.Mutex
+	eventRate            float64
+	interestingEventRate float64
+	dumps                int
+	dumpDuration         time.Duration
+	dumpSize             int
+	handleDumpDuration   time.Duration
+	flushDuration        time.Duration
+	flushSize            int
+	connections          int
+	flowIDReuses         int
+	counterResets        int
+	reapedConnections    int
+	droppedConnections   int
+	foldedKeys           int
+	foldedKeysTotal      int
+	lastInterval         time.Time
+	lastDump             time.Time
+	dumpInterval         time.Duration // expected time between dumps, 0 if dumps only happen on triggers
+	failedFlushes        int           // consecutive flushes with output errors
+}
+
+// Event channel of the main loop (also read for the fill level)
+var eventChannel = make(chan NamespacedEvent, 65536)
+
+type metricValue struct {
+	name, kind, help string
+	value            string
+}
+
+func recordEvent(interesting bool) {
+	atomic.AddUint64(&metrics.events, 1)
+	if interesting {
+		atomic.AddUint64(&metrics.interestingEvents, 1)
+	}
+}
+
+func recordSinkError() {
+	atomic.AddUint64(&metrics.sinkErrors, 1)
+}
+
+func sinkErrorCount() uint64 {
+	return atomic.LoadUint64(&metrics.sinkErrors)
+}
+
+func recordNetlinkError() {
+	atomic.AddUint64(&metrics.netlinkErrors, 1)
+}
+
+func recordDump(dump DumpResult, handleDuration time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.dumps++
+	metrics.lastDump = time.Now()
+	metrics.dumpDuration = dump.duration
+	metrics.dumpSize = dump.size
+	metrics.handleDumpDuration = handleDuration
+	metrics.connections = len(connections)
+	metrics.flowIDReuses = FlowIDReuseCounter
+	metrics.counterResets = CounterResetCounter
+	metrics.reapedConnections = ReapedConnectionCounter
+	metrics.droppedConnections = DroppedConnectionCounter
+}
+
+func recordFlush(size int, duration time.Duration, failed bool) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.flushSize = size
+	metrics.flushDuration = duration
+	if failed {
+		metrics.failedFlushes++
+	} else {
+		metrics.failedFlushes = 0
+	}
+}
+
+// Called whenever the next dump is scheduled (the interval can be changed at runtime)
+func recordDumpInterval() {
+	interval := time.Duration(Interval) * time.Second
+	if RoundLength > 0 {
+		interval = RoundLength
+	}
+	if RoundExternal {
+		interval = 0
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.dumpInterval = interval
+}
+
+// Called once per interval (with -max-keys) with the number of keys folded into "other" rows
+func recordFoldedKeys(folded int) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.foldedKeys = folded
+	metrics.foldedKeysTotal += folded
+}
+
+// Called once per interval with the number of events since the last call
+func recordInterval(events, interestingEvents int) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	now := time.Now()
+	if !metrics.lastInterval.IsZero() {
+		seconds := now.Sub(metrics.lastInterval).Seconds()
+		metrics.eventRate = float64(events) / seconds
+		metrics.interestingEventRate = float64(interestingEvents) / seconds
+	}
+	metrics.lastInterval = now
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func metricValues() []metricValue {
+	metrics.Lock()
+	defer metrics.Unlock()
+	return []metricValue{
+		{"events_total", "counter", "Conntrack events received", strconv.FormatUint(atomic.LoadUint64(&metrics.events), 10)},
+		{"interesting_events_total", "counter", "Conntrack events passing the filters", strconv.FormatUint(atomic.LoadUint64(&metrics.interestingEvents), 10)},
+		{"events_per_second", "gauge", "Conntrack events per second in the last interval", formatFloat(metrics.eventRate)},
+		{"interesting_events_per_second", "gauge", "Interesting conntrack events per second in the last interval", formatFloat(metrics.interestingEventRate)},
+		{"event_channel_length", "gauge", "Events waiting in the event channel", strconv.Itoa(len(eventChannel))},
+		{"event_channel_capacity", "gauge", "Capacity of the event channel", strconv.Itoa(cap(eventChannel))},
+		{"dumps_total", "counter", "Conntrack table dumps", strconv.Itoa(metrics.dumps)},
+		{"dump_duration_seconds", "gauge", "Duration of the last dump", formatFloat(metrics.dumpDuration.Seconds())},
+		{"dump_flows", "gauge", "Flows in the last dump", strconv.Itoa(metrics.dumpSize)},
+		{"handle_dump_duration_seconds", "gauge", "Time to process the last dump", formatFloat(metrics.handleDumpDuration.Seconds())},
+		{"flush_duration_seconds", "gauge", "Duration of the last flush", formatFloat(metrics.flushDuration.Seconds())},
+		{"flush_rows", "gauge", "Rows written by the last flush", strconv.Itoa(metrics.flushSize)},
+		{"connections", "gauge", "Size of the connection table", strconv.Itoa(metrics.connections)},
+		{"flow_id_reuses_total", "counter", "Flow IDs reused by the kernel", strconv.Itoa(metrics.flowIDReuses)},
+		{"counter_resets_total", "counter", "Counters that went backwards", strconv.Itoa(metrics.counterResets)},
+		{"reaped_connections_total", "counter", "Connections removed without DESTROY event", strconv.Itoa(metrics.reapedConnections)},
+		{"dropped_connections_total", "counter", "Connections not tracked because the table was full", strconv.Itoa(metrics.droppedConnections)},
+		{"folded_keys", "gauge", "Keys folded into \"other\" rows in the last interval (-max-keys)", strconv.Itoa(metrics.foldedKeys)},
+		{"folded_keys_total", "counter", "Keys folded into \"other\" rows (-max-keys)", strconv.Itoa(metrics.foldedKeysTotal)},
+		{"sink_errors_total", "counter", "Errors writing output", strconv.FormatUint(atomic.LoadUint64(&metrics.sinkErrors), 10)},
+		{"netlink_errors_total", "counter", "Failed conntrack dumps", strconv.FormatUint(atomic.LoadUint64(&metrics.netlinkErrors), 10)},
+	}
+}
+
+func writePrometheusMetrics(out *strings.Builder) {
+	for _, metric := range metricValues() {
+		name := "conntrack_accounting_" + metric.name
+		out.WriteString("# HELP " + name + " " + metric.help + "\n")
+		out.WriteString("# TYPE " + name + " " + metric.kind + "\n")
+		out.WriteString(name + " " + metric.value + "\n")
+	}
+}
+
+// format: #metrics <time>,name=value,name=value,...
+func formatMetricsLine(timestamp time.Time) string {
+	var out strings.Builder
+	out.WriteString("#metrics ")
+	out.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	for _, metric := range metricValues() {
+		out.WriteString(",")
+		out.WriteString(metric.name)
+		out.WriteString("=")
+		out.WriteString(metric.value)
+	}
+	out.WriteString("\n")
+	return out.String()
+}
+
+func MetricsInit() {
+	RegisterPrometheusMetrics(writePrometheusMetrics)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const NamedNetnsFolder = "/run/netns"
+
+// Network namespaces to monitor (from command line). Empty name: the tool's own namespace.
+// If no namespace is configured, we only monitor our own namespace (Namespaces = [""]).
+var Namespaces = []string{""}
+
+// Add the namespace name as accounting dimension
+var DimensionNamespace bool
+
+// Parse a list of namespace names, "." is our own namespace and "*" expands to all named namespaces
+func NamespacesInit(list string) error {
+	Namespaces = nil
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			continue
+		case name == ".":
+			Namespaces = append(Namespaces, "")
+		case name == "*":
+			files, err := ioutil.ReadDir(NamedNetnsFolder)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				Namespaces = append(Namespaces, file.Name())
+			}
+		case strings.ContainsAny(name, "/,"):
+			return errors.New("Invalid namespace name: " + name)
+		default:
+			if _, err := os.Stat(filepath.Join(NamedNetnsFolder, name)); err != nil {
+				return err
+			}
+			Namespaces = append(Namespaces, name)
+		}
+	}
+	if len(Namespaces) == 0 {
+		return errors.New("no namespace given")
+	}
+	DimensionNamespace = true
+	Log("namespaces").Info("Monitoring network namespaces", "namespaces", strings.Join(NamespaceNames(), ","))
+	return nil
+}
+
+// NamespaceName returns the name used in the output ("-" for our own namespace)
+func NamespaceName(ns int) string {
+	if Namespaces[ns] == "" {
+		return "-"
+	}
+	return Namespaces[ns]
+}
+
+func NamespaceNames() []string {
+	names := make([]string, len(Namespaces))
+	for i := range Namespaces {
+		names[i] = NamespaceName(i)
+	}
+	return names
+}
+
+// Open a conntrack connection inside a namespace
+func DialNamespace(ns int) (*conntrack.Conn, error) {
+	if Namespaces[ns] == "" {
+		return conntrack.Dial(nil)
+	}
+	// the netlink socket stays in the namespace, we only need the handle while dialing
+	f, err := os.Open(filepath.Join(NamedNetnsFolder, Namespaces[ns]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return conntrack.Dial(&netlink.Config{NetNS: int(f.Fd())})
+}
+
+// Run a function inside a namespace, e.g. to access its settings in /proc/sys/net (which belong to the
+// namespace of the thread opening the file)
+func InNamespace(ns int, f func() error) error {
+	if Namespaces[ns] == "" {
+		return f()
+	}
+	result := make(chan error)
+	go func() {
+		// the thread is never unlocked, it terminates with the goroutine instead of running other code in the namespace
+		runtime.LockOSThread()
+		file, err := os.Open(filepath.Join(NamedNetnsFolder, Namespaces[ns]))
+		if err != nil {
+			result <- err
+			return
+		}
+		defer file.Close()
+		err = unix.Setns(int(file.Fd()), unix.CLONE_NEWNET)
+		if err != nil {
+			result <- err
+			return
+		}
+		result <- f()
+	}()
+	return <-result
+}
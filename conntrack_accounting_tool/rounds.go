@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Align flushes to the rounds of a CTF (from command line).
+// Round 1 starts at RoundStart, traffic before is accounted to round 0.
+var RoundStart time.Time
+var RoundLength time.Duration
+
+// Rounds are triggered externally (SIGUSR1) instead of by time
+var RoundExternal bool
+
+// Current round number in external mode
+var externalRound int
+var externalTriggerPending bool
+
+func RoundsEnabled() bool {
+	return RoundLength > 0 || RoundExternal
+}
+
+// Parse a round start, either unix timestamp or RFC3339
+func ParseRoundStart(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errors.New("Invalid round start (unix timestamp or RFC3339): " + s)
+	}
+	return t, nil
+}
+
+// Number of the round that ends with a flush at the given time
+func RoundNumber(flushTime time.Time) int {
+	if RoundExternal {
+		return externalRound
+	}
+	if RoundLength <= 0 {
+		return 0
+	}
+	t := flushTime.Add(-time.Nanosecond)
+	if t.Before(RoundStart) {
+		return 0
+	}
+	return int(t.Sub(RoundStart)/RoundLength) + 1
+}
+
+// Unix timestamp of the next round start
+func nextRoundTimestamp() int64 {
+	now := time.Now()
+	if now.Before(RoundStart) {
+		return RoundStart.Unix()
+	}
+	rounds := now.Sub(RoundStart)/RoundLength + 1
+	return RoundStart.Add(rounds * RoundLength).Unix()
+}
+
+// Create a channel that delivers external round triggers
+func RoundTriggerChannel() chan os.Signal {
+	signalChannel := make(chan os.Signal, 1)
+	if RoundExternal {
+		signal.Notify(signalChannel, syscall.SIGUSR1)
+	}
+	return signalChannel
+}
+
+// Start the next round now (external mode). Returns false if the previous trigger is still pending.
+// If a dump is already running (the first dump after startup), its flush finishes the round.
+func TriggerRound(channel chan DumpResult) bool {
+	if externalTriggerPending {
+		return false
+	}
+	externalTriggerPending = true
+	DumpNow(channel)
+	return true
+}
+
+// Called after the flush of a dump
+func finishRound() {
+	if externalTriggerPending {
+		externalTriggerPending = false
+		externalRound++
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func resetRounds() {
+	RoundStart = time.Time{}
+	RoundLength = 0
+	RoundExternal = false
+	externalRound = 0
+	externalTriggerPending = false
+}
+
+func TestRoundNumberDisabled(t *testing.T) {
+	resetRounds()
+	if RoundsEnabled() {
+		t.Fatal("rounds enabled without -round-length / -round-external")
+	}
+	if round := RoundNumber(time.Now()); round != 0 {
+		t.Fatalf("round = %d, want 0", round)
+	}
+}
+
+func TestRoundNumberExternal(t *testing.T) {
+	resetRounds()
+	RoundExternal = true
+	defer resetRounds()
+	if !RoundsEnabled() {
+		t.Fatal("rounds not enabled with -round-external")
+	}
+	if round := RoundNumber(time.Now()); round != 0 {
+		t.Fatalf("round = %d before the first trigger, want 0", round)
+	}
+	// a flush without trigger does not start a new round
+	finishRound()
+	if round := RoundNumber(time.Now()); round != 0 {
+		t.Fatalf("round = %d after an untriggered flush, want 0", round)
+	}
+	externalTriggerPending = true
+	finishRound()
+	if round := RoundNumber(time.Now()); round != 1 {
+		t.Fatalf("round = %d after a trigger, want 1", round)
+	}
+}
+
+func TestRoundNumberAligned(t *testing.T) {
+	resetRounds()
+	defer resetRounds()
+	start, err := ParseRoundStart("2024-05-01T10:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RoundStart = start
+	RoundLength = 2 * time.Minute
+	tests := []struct {
+		flush time.Time
+		round int
+	}{
+		{start.Add(-time.Minute), 0},
+		{start, 0}, // flush at the start closes the traffic before round 1
+		{start.Add(time.Second), 1},
+		{start.Add(2 * time.Minute), 1}, // flush at the end of round 1
+		{start.Add(2*time.Minute + time.Second), 2},
+		{start.Add(20 * time.Minute), 10},
+	}
+	for _, test := range tests {
+		if round := RoundNumber(test.flush); round != test.round {
+			t.Errorf("RoundNumber(start + %v) = %d, want %d", test.flush.Sub(start), round, test.round)
+		}
+	}
+	if _, err := ParseRoundStart("1714557600"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseRoundStart("yesterday"); err == nil {
+		t.Error("invalid round start accepted")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Version of the csv schema, increased on incompatible changes (renamed, removed or reordered columns).
+// Optional columns are described by the header row.
+const CSVSchemaVersion = 1
+
+// Start csv files (output folder, archive) with the schema line and a header row (from command line).
+// The header is written whenever a file is opened, so rows appended after a restart with other options
+// follow their own header (in a gzip member of their own in compressed archives).
+var CSVHeader bool
+
+// File describing the schema of the output, e.g. for consumers of the pipe (from command line)
+var SchemaFile string
+
+// format: "#schema=<version>" line, then a header row with the column names
+func CSVSchemaHeader() string {
+	return "#schema=" + strconv.Itoa(CSVSchemaVersion) + "\n" + strings.Join(CSVColumns(), ",") + "\n"
+}
+
+// Write the schema file (atomically, consumers might read it at any time)
+func WriteSchemaFile() error {
+	err := os.WriteFile(SchemaFile+".tmp", []byte(CSVSchemaHeader()), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(SchemaFile+".tmp", SchemaFile)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/ti-mo/conntrack"
+)
+
+// Attribute flows to the side with an interesting port (from command line).
+// By default, traffic is accounted to the peer that opened the connection. In this mode, a connection
+// that originates from an interesting port (e.g. a victim service connecting back to an exploit) is
+// accounted reversed: src / dst, port and the traffic direction are swapped, and the direction column says "reverse".
+var ServiceSideAttribution bool
+
+// Check if a flow should be accounted reversed
+func ServiceSideReversed(flow *conntrack.Flow) bool {
+	if !ServiceSideAttribution {
+		return false
+	}
+	proto := ProtoLookup(flow.TupleOrig.Proto.Protocol)
+	return !PortIsInteresting(proto, DestPort(flow)) && PortIsInteresting(proto, SourcePort(flow))
+}
+
+func DirectionName(reversed bool) string {
+	if reversed {
+		return "reverse"
+	}
+	return "forward"
+}
+
+// Counters of a flow, from the perspective of the accounting key (swapped for reversed flows)
+func flowCounters(flow *conntrack.Flow, reversed bool) (conntrack.Counter, conntrack.Counter) {
+	if reversed {
+		return flow.CountersReply, flow.CountersOrig
+	}
+	return flow.CountersOrig, flow.CountersReply
+}
+
+// Copy the (nonzero) counters of a flow into a connection
+func updateConnectionCounters(info *ConnectionInfo, flow *conntrack.Flow) {
+	srcToDst, dstToSrc := flowCounters(flow, info.reversed)
+	if srcToDst.Packets != 0 && srcToDst.Bytes != 0 {
+		info.packetsSrcToDst = srcToDst.Packets
+		info.bytesSrcToDst = srcToDst.Bytes
+	}
+	if dstToSrc.Packets != 0 && dstToSrc.Bytes != 0 {
+		info.packetsDstToSrc = dstToSrc.Packets
+		info.bytesDstToSrc = dstToSrc.Bytes
+	}
+}
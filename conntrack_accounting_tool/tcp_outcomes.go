@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/ti-mo/conntrack"
+)
+
+// Track how TCP connections end (from command line)
+var TrackTCPOutcomes bool
+
+// Possible outcomes of a TCP connection. Orderly closed connections are only counted as established.
+const (
+	TCPOutcomeRefused         = iota // RST in reply to the SYN
+	TCPOutcomeHandshakeFailed        // no (valid) answer, stuck in SYN_SENT / SYN_RECV until timeout
+	TCPOutcomeReset                  // established connection closed by RST
+	TCPOutcomeTimeout                // established connection expired without being closed
+)
+
+// Update the TCP state of a tracked connection, from an UPDATE or DESTROY event
+func handleTCPState(info *ConnectionInfo, flow *conntrack.Flow, destroyed bool) {
+	if !info.tcpTracked || info.tcpOutcomeDone {
+		return
+	}
+	state := uint8(TCP_CONNTRACK_NONE)
+	if flow.ProtoInfo.TCP != nil {
+		state = flow.ProtoInfo.TCP.State
+	}
+	switch state {
+	case TCP_CONNTRACK_ESTABLISHED:
+		if !info.tcpEstablished {
+			info.tcpEstablished = true
+			AccountTCPEstablished(info)
+		}
+	case TCP_CONNTRACK_FIN_WAIT, TCP_CONNTRACK_CLOSE_WAIT, TCP_CONNTRACK_LAST_ACK, TCP_CONNTRACK_TIME_WAIT:
+		info.tcpClosing = true
+	case TCP_CONNTRACK_CLOSE:
+		if !info.tcpEstablished {
+			if flow.Status.SeenReply() {
+				finishTCPOutcome(info, TCPOutcomeRefused)
+			} else {
+				finishTCPOutcome(info, TCPOutcomeHandshakeFailed)
+			}
+		} else if !info.tcpClosing {
+			finishTCPOutcome(info, TCPOutcomeReset)
+		} else {
+			info.tcpOutcomeDone = true
+		}
+		return
+	}
+	if destroyed {
+		if !info.tcpEstablished {
+			finishTCPOutcome(info, TCPOutcomeHandshakeFailed)
+		} else if !info.tcpClosing {
+			finishTCPOutcome(info, TCPOutcomeTimeout)
+		}
+	}
+}
+
+func finishTCPOutcome(info *ConnectionInfo, outcome int) {
+	info.tcpOutcomeDone = true
+	AccountTCPOutcome(info, outcome)
+}
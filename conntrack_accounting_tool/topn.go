@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/heap"
+	"strings"
+)
+
+// Maximal number of keys per interval (from command line), 0 = unlimited.
+// The keys are chosen with the Space-Saving heavy-hitter algorithm: when the table is full, the key with the
+// least traffic is folded into the "other" row of its protocol, and the new key inherits its traffic estimate.
+// That way the top-N keys by bytes are kept with bounded memory.
+var MaxKeys int
+
+// Keys folded into "other" rows during the current interval
+var FoldedKeyCounter int
+
+// Rows of folded keys, per protocol
+var otherEntries = make(map[FlowKey]*AccountingEntry)
+
+// Min-heap of all entries in the accounting table, by traffic estimate
+type entryHeap []*AccountingEntry
+
+var topNHeap entryHeap
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].estimate < h[j].estimate }
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *entryHeap) Push(x interface{}) {
+	entry := x.(*AccountingEntry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	entry.heapIndex = -1
+	return entry
+}
+
+// Key of the "other" row: protocol and dimensions are kept, everything else is "other" / -1
+func otherKey(key FlowKey) FlowKey {
+	proto := key.key[:strings.IndexByte(key.key, ',')]
+	return FlowKey{proto + ",other,other,-1", strings.Repeat(",other", len(DimensionNames()))}
+}
+
+// Make room for a new key. Returns the traffic estimate the new key starts with.
+func topNMakeRoom() uint64 {
+	if MaxKeys <= 0 || len(AccountingTable) < MaxKeys {
+		return 0
+	}
+	evicted := heap.Pop(&topNHeap).(*AccountingEntry)
+	delete(AccountingTable, evicted.key)
+	other := otherEntries[otherKey(evicted.key)]
+	if other == nil {
+		other = &AccountingEntry{}
+		otherEntries[otherKey(evicted.key)] = other
+	}
+	other.Add(evicted)
+	FoldedKeyCounter++
+	return evicted.estimate
+}
+
+func topNAdd(entry *AccountingEntry) {
+	if MaxKeys > 0 {
+		heap.Push(&topNHeap, entry)
+	}
+}
+
+// Update the traffic estimate of an entry
+func topNUpdate(entry *AccountingEntry, bytes uint64) {
+	if MaxKeys > 0 && bytes > 0 {
+		entry.estimate += bytes
+		heap.Fix(&topNHeap, entry.heapIndex)
+	}
+}
+
+// Move the "other" rows into the accounting table before it is written, and reset for the next interval
+func topNFinish() {
+	if MaxKeys <= 0 {
+		return
+	}
+	recordFoldedKeys(FoldedKeyCounter)
+	if FoldedKeyCounter > 0 {
+		Log("output").Info("Folded keys into \"other\" rows", "folded_keys", FoldedKeyCounter, "other_rows", len(otherEntries))
+	}
+	for key, entry := range otherEntries {
+		AccountingTable[key] = entry
+	}
+	otherEntries = make(map[FlowKey]*AccountingEntry)
+	topNHeap = nil
+	FoldedKeyCounter = 0
+}
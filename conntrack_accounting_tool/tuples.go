@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"github.com/ti-mo/conntrack"
+	"net/netip"
+)
+
+// Which tuple is used to determine source / destination of a flow.
+// With NAT, the translated addresses are only visible in the reply tuple.
+const (
+	AddressOrig  = 0 // original tuple (before NAT)
+	AddressReply = 1 // reply tuple (after NAT)
+	AddressBoth  = 2 // original tuple, the reply tuple address is emitted as additional column
+)
+
+var SourceAddressMode = AddressOrig
+var DestAddressMode = AddressOrig
+
+func ParseAddressMode(s string) (int, error) {
+	switch s {
+	case "orig":
+		return AddressOrig, nil
+	case "reply":
+		return AddressReply, nil
+	case "both":
+		return AddressBoth, nil
+	}
+	return 0, errors.New("Invalid address mode (orig/reply/both): " + s)
+}
+
+// The source of the connection, as seen by the destination
+func sourceAddressReply(flow *conntrack.Flow) netip.Addr {
+	if flow.TupleReply.IP.DestinationAddress.IsValid() {
+		return flow.TupleReply.IP.DestinationAddress
+	}
+	return flow.TupleOrig.IP.SourceAddress
+}
+
+// The destination of the connection, as seen by the source
+func destAddressReply(flow *conntrack.Flow) netip.Addr {
+	if flow.TupleReply.IP.SourceAddress.IsValid() {
+		return flow.TupleReply.IP.SourceAddress
+	}
+	return flow.TupleOrig.IP.DestinationAddress
+}
+
+// Source address used for filtering and grouping
+func SourceAddress(flow *conntrack.Flow) netip.Addr {
+	if SourceAddressMode == AddressReply {
+		return sourceAddressReply(flow)
+	}
+	return flow.TupleOrig.IP.SourceAddress
+}
+
+// Destination address used for filtering and grouping
+func DestAddress(flow *conntrack.Flow) netip.Addr {
+	if DestAddressMode == AddressReply {
+		return destAddressReply(flow)
+	}
+	return flow.TupleOrig.IP.DestinationAddress
+}
+
+// Destination port used for grouping, ports can be translated by NAT too
+func DestPort(flow *conntrack.Flow) uint16 {
+	if DestAddressMode == AddressReply && flow.TupleReply.IP.SourceAddress.IsValid() {
+		return flow.TupleReply.Proto.SourcePort
+	}
+	return flow.TupleOrig.Proto.DestinationPort
+}
+
+// Source port used for grouping
+func SourcePort(flow *conntrack.Flow) uint16 {
+	if SourceAddressMode == AddressReply && flow.TupleReply.IP.DestinationAddress.IsValid() {
+		return flow.TupleReply.Proto.DestinationPort
+	}
+	return flow.TupleOrig.Proto.SourcePort
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Read a config file ("name = value" per line with the names of the command line flags, a subset of TOML)
+// and apply all options that were not given on the command line.
+func ConfigFileInit(fname string) error {
+	commandLineFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid line (not format \"name = value\"): " + line)
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "-")
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return errors.New("Invalid string in line: " + line)
+			}
+		}
+		if commandLineFlags[name] {
+			continue
+		}
+		err = flag.Set(name, value)
+		if err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+func checkDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(path + " is not a directory")
+	}
+	return nil
+}
+
+// Validate folders, schema and input files (-check-config)
+func CheckConfiguration(watchFolder, moveFolder, schemaFile string, files []string) error {
+	if watchFolder != "" {
+		if err := checkDirectory(watchFolder); err != nil {
+			return errors.New("Watch folder: " + err.Error())
+		}
+	}
+	if moveFolder != "" {
+		if err := checkDirectory(moveFolder); err != nil {
+			return errors.New("Move folder: " + err.Error())
+		}
+	}
+	if schemaFile != "" {
+		if _, err := ReadSchemaFile(schemaFile); err != nil {
+			return errors.New("Schema file: " + err.Error())
+		}
+	}
+	for _, fname := range files {
+		if _, err := os.Stat(fname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print the effective configuration in config file format (without the password)
+func PrintConfig() {
+	flag.VisitAll(func(f *flag.Flag) {
+		switch {
+		case f.Name == "config" || f.Name == "check-config":
+			return
+		case f.Name == "pass" && f.Value.String() != "":
+			fmt.Printf("%s = \"***\"\n", f.Name)
+		default:
+			if value, ok := f.Value.(flag.Getter).Get().(string); ok {
+				fmt.Printf("%s = %s\n", f.Name, strconv.Quote(value))
+			} else {
+				fmt.Printf("%s = %s\n", f.Name, f.Value.String())
+			}
+		}
+	})
+}
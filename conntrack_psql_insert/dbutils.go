@@ -1,14 +1,16 @@
 package main
 
 import (
+	"compress/gzip"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 	"io"
-	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +31,17 @@ type StatsEntry struct {
 	openConnections int
 }
 
+type MatrixEntry struct {
+	time        time.Time
+	proto       string
+	port        int
+	src         string
+	dst         string
+	packets     int64
+	bytes       int64
+	connections int
+}
+
 type Database struct {
 	db *sql.DB
 }
@@ -54,9 +67,9 @@ func (database *Database) CreateTable() {
 CREATE TABLE IF NOT EXISTS vpn_traffic (
 	id serial PRIMARY KEY,
 	time timestamp with time zone NOT NULL,
-	src varchar(16) NOT NULL,
-	dst varchar(16) NOT NULL,
-	proto varchar(4) NOT NULL,
+	src text NOT NULL,
+	dst text NOT NULL,
+	proto text NOT NULL,
 	port INT NOT NULL,
 	src_packets BIGINT NOT NULL,
 	src_bytes BIGINT NOT NULL,
@@ -71,114 +84,229 @@ CREATE INDEX IF NOT EXISTS vpn_traffic_time_idx ON vpn_traffic ("time" DESC);
 CREATE INDEX IF NOT EXISTS vpn_traffic_src_idx ON vpn_traffic ("src");
 CREATE INDEX IF NOT EXISTS vpn_traffic_dst_idx ON vpn_traffic ("dst");
 CREATE INDEX IF NOT EXISTS vpn_traffic_proto_port_idx ON vpn_traffic ("proto", "port");
+CREATE TABLE IF NOT EXISTS vpn_traffic_matrix (
+	time timestamp with time zone NOT NULL,
+	proto text NOT NULL,
+	port INT NOT NULL,
+	src text NOT NULL,
+	dst text NOT NULL,
+	packets BIGINT NOT NULL,
+	bytes BIGINT NOT NULL,
+	connections INT NOT NULL,
+	PRIMARY KEY(time, proto, port, src, dst)
+);
 `)
 	if err != nil {
-		log.Fatal(err)
+		Fatal("db", "Database error", "err", err)
+	}
+	database.widenColumns()
+}
+
+// Tables created by older versions have varchar columns: protocol names like "udplite" (pseudo-connections)
+// are longer than 4 characters, group labels (-group-rules) longer than an IPv4 address.
+// ALTER TABLE locks the table, so only columns that still need it are changed.
+func (database *Database) widenColumns() {
+	rows, err := database.db.Query(`
+SELECT table_name, column_name FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name IN ('vpn_traffic', 'vpn_traffic_matrix')
+	AND column_name IN ('proto', 'src', 'dst') AND data_type = 'character varying'`)
+	if err != nil {
+		Fatal("db", "Database error", "err", err)
+	}
+	var columns [][2]string
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			Fatal("db", "Database error", "err", err)
+		}
+		columns = append(columns, [2]string{table, column})
+	}
+	if err := rows.Err(); err != nil {
+		Fatal("db", "Database error", "err", err)
+	}
+	rows.Close()
+	for _, column := range columns {
+		_, err := database.db.Exec("ALTER TABLE " + pq.QuoteIdentifier(column[0]) + " ALTER COLUMN " + pq.QuoteIdentifier(column[1]) + " TYPE text")
+		if err != nil {
+			Fatal("db", "Database error", "err", err)
+		}
+		Log("db").Info("Changed column type to text", "table", column[0], "column", column[1])
+	}
+}
+
+// A compressed csv file (gzip or zstd)
+type compressedFile struct {
+	io.ReadCloser
+	file *os.File
+	name string
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		// archive file that was not closed properly, everything up to the last flush is complete
+		Log("import").Warn("Compressed file is truncated, importing the complete part", "file", f.name)
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *compressedFile) Close() error {
+	_ = f.ReadCloser.Close()
+	return f.file.Close()
+}
+
+// Open a csv file, files ending with ".gz" or ".zst" are decompressed transparently
+func openCSV(fname string) (io.ReadCloser, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.ReadCloser
+	switch strings.ToLower(path.Ext(fname)) {
+	case ".gz":
+		reader, err = gzip.NewReader(file)
+	case ".zst":
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(file)
+		if err == nil {
+			reader = decoder.IOReadCloser()
+		}
+	default:
+		return file, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
+	return &compressedFile{reader, file, fname}, nil
 }
 
-func readCSV(fname string) []StatsEntry {
-	csvfile, err := os.Open(fname)
+// Read a traffic csv file. Columns are found by name from the header row ("#schema=<version>" line
+// followed by the column names), the schema file or the legacy format without additional columns.
+// Invalid files are rejected with an error.
+func readCSV(fname string) ([]StatsEntry, error) {
+	csvfile, err := openCSV(fname)
 	if err != nil {
-		log.Fatal("Couldn't open the csv file", err)
+		return nil, err
 	}
+	defer csvfile.Close()
 
 	entries := make([]StatsEntry, 0, 2048)
 
 	r := csv.NewReader(csvfile)
+	r.FieldsPerRecord = -1
+	var schema *CSVSchema
+	headerVersion := 0
 	for {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		if len(record) < 2 {
+		line, _ := r.FieldPos(0)
+		if strings.HasPrefix(record[0], "#") {
+			version, err := parseSchemaLine(record[0])
+			if err != nil {
+				return nil, err
+			}
+			if version > 0 {
+				headerVersion = version
+			}
 			continue
 		}
-		// format: time,proto,src,dst,port,packets_src,packets_dst,bytes_src,bytes_dst,connection_count,connection_time,open_connections
-		t, err := strconv.ParseInt(record[0], 10, 64)
-		if err != nil {
-			log.Fatal("Invalid t: ", err)
-		}
-		port, err := strconv.ParseInt(record[4], 10, 32)
-		if err != nil {
-			log.Fatal("Invalid port: ", err)
-		}
-		srcPackets, err := strconv.ParseInt(record[5], 10, 64)
-		if err != nil {
-			log.Fatal("Invalid src_packets: ", err)
-		}
-		srcBytes, err := strconv.ParseInt(record[7], 10, 64)
-		if err != nil {
-			log.Fatal("Invalid src_bytes: ", err)
+		if headerVersion > 0 {
+			// header row after the schema line
+			schema, err = NewCSVSchema(headerVersion, record)
+			if err != nil {
+				return nil, err
+			}
+			headerVersion = 0
+			continue
 		}
-		dstPackets, err := strconv.ParseInt(record[6], 10, 64)
-		if err != nil {
-			log.Fatal("Invalid dst_packets: ", err)
+		if len(record) < 2 {
+			continue
 		}
-		dstBytes, err := strconv.ParseInt(record[8], 10, 64)
-		if err != nil {
-			log.Fatal("Invalid dst_bytes: ", err)
+		if schema == nil && record[0] == "time" {
+			return nil, fmt.Errorf("line %d: header row without \"#schema=<version>\" line", line)
 		}
-		connectionTimes, err := strconv.ParseInt(record[10], 10, 32)
-		if err != nil {
-			log.Fatal("Invalid connection_times: ", err)
+		if schema == nil {
+			schema = DefaultSchema
+			if schema == nil {
+				schema, err = legacySchema(len(record))
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
-		connectionCount, err := strconv.ParseInt(record[9], 10, 32)
-		if err != nil {
-			log.Fatal("Invalid connection_count: ", err)
+		if len(record) < len(schema.columns) {
+			return nil, fmt.Errorf("line %d: %d columns, expected %d", line, len(record), len(schema.columns))
 		}
-		openConnections := int64(0)
-		if len(record) > 11 {
-			openConnections, err = strconv.ParseInt(record[11], 10, 32)
-			if err != nil {
-				log.Fatal("Invalid open_connections: ", err)
+		var parseErr error
+		parseInt := func(name string, bitSize int) int64 {
+			i := schema.index(name)
+			if i < 0 {
+				return 0
+			}
+			value, err := strconv.ParseInt(record[i], 10, bitSize)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("line %d: invalid %s: %w", line, name, err)
 			}
+			return value
 		}
+		t := parseInt("time", 64)
 		entries = append(entries, StatsEntry{
 			time:            time.Unix(t/1000000000, t%1000000000),
-			src:             record[2],
-			dst:             record[3],
-			proto:           record[1],
-			port:            int(port),
-			srcPackets:      srcPackets,
-			srcBytes:        srcBytes,
-			dstPackets:      dstPackets,
-			dstBytes:        dstBytes,
-			connectionTimes: int(connectionTimes),
-			connectionCount: int(connectionCount),
-			openConnections: int(openConnections),
+			src:             record[schema.index("src")],
+			dst:             record[schema.index("dst")],
+			proto:           record[schema.index("proto")],
+			port:            int(parseInt("port", 32)),
+			srcPackets:      parseInt("packets_src", 64),
+			srcBytes:        parseInt("bytes_src", 64),
+			dstPackets:      parseInt("packets_dst", 64),
+			dstBytes:        parseInt("bytes_dst", 64),
+			connectionTimes: int(parseInt("connection_time", 32)),
+			connectionCount: int(parseInt("connection_count", 32)),
+			openConnections: int(parseInt("open_connections", 32)),
 		})
+		if parseErr != nil {
+			return nil, parseErr
+		}
 	}
-	return entries
+	return entries, nil
 }
 
-func (database *Database) InsertCSV(fname string) {
+// Import a traffic csv file, files with unknown schema are rejected
+func (database *Database) InsertCSV(fname string) error {
 	start := time.Now()
 
 	// Load CSV
-	stats := readCSV(fname)
+	stats, err := readCSV(fname)
+	if err != nil {
+		return err
+	}
 
 	// Save to database
 	txn, err := database.db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		Fatal("db", "Database error", "err", err)
 	}
 
 	//err = database.copyfrom(txn, stats)
 	err = database.bulkInsert(txn, stats)
 	if err != nil {
-		log.Fatal(err)
+		Fatal("db", "Database error", "err", err)
 	}
 
 	err = txn.Commit()
 	if err != nil {
-		log.Fatal(err)
+		Fatal("db", "Database error", "err", err)
 	}
 
-	log.Printf("Imported %d entries in %d ms\n", len(stats), time.Now().Sub(start).Milliseconds())
+	Log("import").Info("Imported file", "file", fname, "entries", len(stats), "duration_ms", time.Now().Sub(start).Milliseconds())
+	return nil
 }
 
 // COPY IN variant - not save if data is repeated
@@ -187,7 +315,7 @@ func (database *Database) copyfrom(txn *sql.Tx, stats []StatsEntry) error {
 	for _, stat := range stats {
 		_, err := stmt.Exec(stat.time, stat.src, stat.dst, stat.proto, stat.port, stat.srcPackets, stat.srcBytes, stat.dstPackets, stat.dstBytes, stat.connectionTimes, stat.connectionCount, stat.openConnections)
 		if err != nil {
-			log.Fatal(err)
+			Fatal("db", "Database error", "err", err)
 		}
 	}
 	_, err := stmt.Exec()
@@ -249,3 +377,105 @@ func (database *Database) bulkInsert(tx *sql.Tx, unsavedRows []StatsEntry) error
 		return nil
 	}
 }
+
+func readMatrixCSV(fname string) []MatrixEntry {
+	csvfile, err := openCSV(fname)
+	if err != nil {
+		Fatal("import", "Could not open csv file", "file", fname, "err", err)
+	}
+	defer csvfile.Close()
+
+	entries := make([]MatrixEntry, 0, 2048)
+
+	r := csv.NewReader(csvfile)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Fatal("import", "Could not read csv file", "file", fname, "err", err)
+		}
+		if len(record) < 8 {
+			continue
+		}
+		// format: time,proto,port,src,dst,packets,bytes,connections
+		t, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			Fatal("import", "Invalid t", "file", fname, "err", err)
+		}
+		port, err := strconv.ParseInt(record[2], 10, 32)
+		if err != nil {
+			Fatal("import", "Invalid port", "file", fname, "err", err)
+		}
+		packets, err := strconv.ParseInt(record[5], 10, 64)
+		if err != nil {
+			Fatal("import", "Invalid packets", "file", fname, "err", err)
+		}
+		bytes, err := strconv.ParseInt(record[6], 10, 64)
+		if err != nil {
+			Fatal("import", "Invalid bytes", "file", fname, "err", err)
+		}
+		connections, err := strconv.ParseInt(record[7], 10, 32)
+		if err != nil {
+			Fatal("import", "Invalid connections", "file", fname, "err", err)
+		}
+		entries = append(entries, MatrixEntry{
+			time:        time.Unix(t/1000000000, t%1000000000),
+			proto:       record[1],
+			port:        int(port),
+			src:         record[3],
+			dst:         record[4],
+			packets:     packets,
+			bytes:       bytes,
+			connections: int(connections),
+		})
+	}
+	return entries
+}
+
+func (database *Database) InsertMatrixCSV(fname string) {
+	start := time.Now()
+
+	// Load CSV
+	matrix := readMatrixCSV(fname)
+
+	// Save to database
+	txn, err := database.db.Begin()
+	if err != nil {
+		Fatal("db", "Database error", "err", err)
+	}
+
+	err = database.bulkInsertMatrix(txn, matrix)
+	if err != nil {
+		Fatal("db", "Database error", "err", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		Fatal("db", "Database error", "err", err)
+	}
+
+	Log("import").Info("Imported matrix file", "file", fname, "entries", len(matrix), "duration_ms", time.Now().Sub(start).Milliseconds())
+}
+
+// INSERT INTO variant for the traffic matrix
+func (database *Database) bulkInsertMatrix(tx *sql.Tx, unsavedRows []MatrixEntry) error {
+	valueStrings := make([]string, 0, 500)
+	valueArgs := make([]interface{}, 0, 4000)
+	for i, row := range unsavedRows {
+		n := (i % 500) * 8
+		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8))
+		valueArgs = append(valueArgs, row.time, row.proto, row.port, row.src, row.dst, row.packets, row.bytes, row.connections)
+		if len(valueStrings) == 500 || i == len(unsavedRows)-1 { // bulk size
+			stmt := fmt.Sprintf("INSERT INTO vpn_traffic_matrix (\"time\", proto, port, src, dst, packets, bytes, connections) VALUES %s ON CONFLICT DO NOTHING", strings.Join(valueStrings, ","))
+			_, err := tx.Exec(stmt, valueArgs...)
+			if err != nil {
+				return err
+			}
+			valueStrings = valueStrings[:0]
+			valueArgs = valueArgs[:0]
+		}
+	}
+	return nil
+}
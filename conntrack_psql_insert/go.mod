@@ -1,9 +1,10 @@
 module psql_insert
 
-go 1.17
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/klauspost/compress v1.17.4
 	github.com/lib/pq v1.10.9
 )
 
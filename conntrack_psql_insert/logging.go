@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logging is structured (log/slog), like in conntrack_accounting. Every message has a "component" attribute,
+// durations are logged as "<name>_ms" (milliseconds), counts as plain integers.
+
+// Log level and format (from command line)
+var LogLevel = "info"
+var LogFormat = "text"
+
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, errors.New("Invalid log level (debug, info, warn or error): " + s)
+	}
+	return level, nil
+}
+
+func LoggingInit() error {
+	level, err := ParseLogLevel(LogLevel)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(LogFormat) {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return errors.New("Invalid log format (text or json): " + LogFormat)
+	}
+	return nil
+}
+
+// Logger for a component of the tool
+func Log(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// Log an error and terminate
+func Fatal(component, msg string, args ...any) {
+	Log(component).Error(msg, args...)
+	os.Exit(1)
+}
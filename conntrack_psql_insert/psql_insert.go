@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"github.com/fsnotify/fsnotify"
-	"log"
 	"os"
 	"os/signal"
 	"path"
@@ -15,12 +14,12 @@ import (
 func watchFolderForCSV(directory string) chan string {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal("fsnotify.NewWatcher:", err)
+		Fatal("watch", "fsnotify.NewWatcher failed", "err", err)
 	}
 
 	err = watcher.Add(directory)
 	if err != nil {
-		log.Fatal("watcher.Add: ", err)
+		Fatal("watch", "watcher.Add failed", "folder", directory, "err", err)
 	}
 
 	files := make(chan string, 512)
@@ -31,19 +30,26 @@ func watchFolderForCSV(directory string) chan string {
 			select {
 			case event, ok := <-watcher.Events:
 				if !ok {
-					log.Fatal("fswatcher event not ok", event)
+					Fatal("watch", "File watcher closed", "event", event.String())
 				}
 				// log.Println("event:", event)
+				name := strings.ToLower(event.Name)
 				if event.Op&fsnotify.Write == fsnotify.Write {
-					if strings.HasSuffix(strings.ToLower(event.Name), ".csv") {
+					if strings.HasSuffix(name, ".csv") {
+						files <- event.Name
+					}
+				}
+				// archive files appear complete (renamed from ".part"), which is only a Create event
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					if strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".csv.gz") || strings.HasSuffix(name, ".csv.zst") {
 						files <- event.Name
 					}
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
-					log.Fatal("fswatcher fatal error:", err)
+					Fatal("watch", "File watcher failed", "err", err)
 				}
-				log.Println("fswatcher error:", err)
+				Log("watch").Warn("File watcher error", "err", err)
 			}
 		}
 	}()
@@ -89,12 +95,43 @@ func main() {
 	passwd := flag.String("pass", "", "Postgresql password")
 	watchFolder := flag.String("watch", "", "Watch this folder for incoming csv's")
 	watchMoveFolder := flag.String("move", "", "Move files after they have been read")
+	configFile := flag.String("config", "", "Configuration file (\"name = value\" per line, names of the command line options)")
+	schemaFile := flag.String("schema", "", "Schema file of csv files without header row (written by conntrack_accounting -schema-file)")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print the effective configuration and exit")
+	flag.StringVar(&LogLevel, "log-level", LogLevel, "Log level: debug, info, warn or error")
+	flag.StringVar(&LogFormat, "log-format", LogFormat, "Log format: text or json")
 	flag.Parse()
 
+	if *configFile != "" {
+		err := ConfigFileInit(*configFile)
+		if err != nil {
+			Fatal("config", "Could not read config file", "file", *configFile, "err", err)
+		}
+	}
+	if err := LoggingInit(); err != nil {
+		Fatal("config", "Invalid logging configuration", "err", err)
+	}
+	if *checkConfig {
+		err := CheckConfiguration(*watchFolder, *watchMoveFolder, *schemaFile, flag.Args())
+		if err != nil {
+			Fatal("config", "Invalid configuration", "err", err)
+		}
+		PrintConfig()
+		return
+	}
+
+	if *schemaFile != "" {
+		var err error
+		DefaultSchema, err = ReadSchemaFile(*schemaFile)
+		if err != nil {
+			Fatal("config", "Invalid schema file", "file", *schemaFile, "err", err)
+		}
+	}
+
 	db := Database{}
 	err := db.Open(*username, *passwd, *hostname, *database)
 	if err != nil {
-		log.Fatal("DB open:", err)
+		Fatal("db", "Could not open database", "err", err)
 	}
 	defer db.Close()
 
@@ -103,11 +140,23 @@ func main() {
 
 	// how to handle files
 	handleFile := func (fname string) {
-		db.InsertCSV(fname)
+		switch {
+		case strings.HasPrefix(path.Base(fname), "matrix_"):
+			db.InsertMatrixCSV(fname)
+		case strings.HasPrefix(path.Base(fname), "histograms_"):
+			Log("import").Info("Skipping histogram file", "file", fname)
+		default:
+			err := db.InsertCSV(fname)
+			if err != nil {
+				// keep the file where it is, it can be imported after an update
+				Log("import").Error("Rejected file", "file", fname, "err", err)
+				return
+			}
+		}
 		if watchMoveFolder != nil && *watchMoveFolder != "" {
 			err := os.Rename(fname, path.Join(*watchMoveFolder, path.Base(fname)))
 			if err != nil {
-				log.Println("Move error:", err)
+				Log("import").Error("Could not move file", "file", fname, "err", err)
 			}
 		}
 	}
@@ -125,10 +174,10 @@ func main() {
 		for {
 			select {
 			case fname := <-files:
-				log.Printf("Loading file %s ...\n", fname)
+				Log("import").Info("Loading file", "file", fname)
 				go handleFile(fname)
 			case sig := <-signalChannel:
-				log.Println("[Signal] Terminating with signal \"" + sig.String() + "\" ...")
+				Log("main").Info("Terminating", "signal", sig.String())
 				return
 			}
 		}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Newest schema version of the traffic csv files (written by conntrack_accounting with -csv-header or -schema-file)
+const SupportedSchemaVersion = 1
+
+// Schema of files without header row (from command line, schema file of conntrack_accounting)
+var DefaultSchema *CSVSchema
+
+// Columns we need, other counter columns are ignored
+var requiredColumns = []string{"time", "proto", "src", "dst", "port", "packets_src", "packets_dst", "bytes_src", "bytes_dst", "connection_count", "connection_time"}
+
+// Dimension columns of conntrack_accounting split the rows of one (time, src, dst, proto, port) key.
+// The table has no columns for them and keeps one row per key, the other rows would be dropped silently.
+var dimensionColumns = []string{"namespace", "zone", "mark", "labels", "src_port", "src_reply", "dst_reply", "direction"}
+
+// Column positions of a traffic csv file
+type CSVSchema struct {
+	version int
+	columns map[string]int
+}
+
+// Parse a "#schema=<version>" line, returns 0 for other lines
+func parseSchemaLine(line string) (int, error) {
+	if !strings.HasPrefix(line, "#schema=") {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(line, "#schema="))
+	if err != nil || version <= 0 {
+		return 0, errors.New("Invalid schema line: " + line)
+	}
+	if version > SupportedSchemaVersion {
+		return 0, errors.New("Unknown schema version " + strconv.Itoa(version) + " (supported: " + strconv.Itoa(SupportedSchemaVersion) + ")")
+	}
+	return version, nil
+}
+
+func NewCSVSchema(version int, header []string) (*CSVSchema, error) {
+	schema := &CSVSchema{version, make(map[string]int)}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if _, ok := schema.columns[name]; ok {
+			return nil, errors.New("Duplicate column: " + name)
+		}
+		schema.columns[name] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := schema.columns[name]; !ok {
+			return nil, errors.New("Missing column: " + name)
+		}
+	}
+	for _, name := range dimensionColumns {
+		if _, ok := schema.columns[name]; ok {
+			return nil, errors.New("Unsupported dimension column (rows would collide in the database): " + name)
+		}
+	}
+	return schema, nil
+}
+
+// Files without header and schema file (before schema versions) can only have the basic columns
+func legacySchema(width int) (*CSVSchema, error) {
+	switch width {
+	case 11:
+		return NewCSVSchema(0, requiredColumns)
+	case 12:
+		return NewCSVSchema(0, append(requiredColumns[:11:11], "open_connections"))
+	}
+	return nil, errors.New("Unknown schema: " + strconv.Itoa(width) + " columns without header row or schema file")
+}
+
+// Read a schema file ("#schema=<version>" line and header row)
+func ReadSchemaFile(fname string) (*CSVSchema, error) {
+	file, err := openCSV(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 2 || len(records[0]) != 1 {
+		return nil, errors.New("Invalid schema file (expected \"#schema=<version>\" and a header row): " + fname)
+	}
+	version, err := parseSchemaLine(records[0][0])
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, errors.New("Invalid schema file (missing \"#schema=<version>\"): " + fname)
+	}
+	return NewCSVSchema(version, records[1])
+}
+
+// Position of a column, -1 if it does not exist
+func (schema *CSVSchema) index(name string) int {
+	if i, ok := schema.columns[name]; ok {
+		return i
+	}
+	return -1
+}